@@ -2,9 +2,10 @@ package retryhttp
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"strings"
 	"time"
@@ -44,7 +45,7 @@ type defaultDoHijackCloserFactory struct{}
 var DefaultDoHijackCloserFactory DoHijackCloserFactory = defaultDoHijackCloserFactory{}
 
 func (f defaultDoHijackCloserFactory) NewDoHijackCloser(c net.Conn, r *bufio.Reader) DoHijackCloser {
-	return httputil.NewClientConn(c, r)
+	return newClientConn(c, r)
 }
 
 //counterfeiter:generate . HijackCloser
@@ -60,28 +61,98 @@ type HijackableClient interface {
 	Do(req *http.Request) (*http.Response, HijackCloser, error)
 }
 
+// DirectClient is implemented by HijackableClients that do not always send a
+// request to the host of its URL. Direct reports whether they do for the
+// given request; a RetryHijackableClient only consults its HealthProber about
+// requests that are sent directly.
+type DirectClient interface {
+	Direct(req *http.Request) bool
+}
+
 type BasicHijackableClient struct {
-	Dial                  func(network, addr string) (net.Conn, error)
+	Dial func(network, addr string) (net.Conn, error)
+
+	// DialContext, if set, is used instead of Dial with the request's
+	// context.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Proxy, if set, returns the proxy to tunnel a request's connection
+	// through, e.g. http.ProxyFromEnvironment. Both HTTP and https proxies,
+	// using CONNECT, and SOCKS5 proxies are supported, with credentials taken
+	// from the proxy URL. A nil URL means no proxy.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// SocketPath, if set, is the unix socket every request is sent to,
+	// whatever the host of its URL.
+	SocketPath string
+
+	// TLSConfig is used for https URLs, with ServerName defaulting to the
+	// URL's host. The handshake is done before the request is written and
+	// must complete within TLSHandshakeTimeout, defaulting to 10 seconds.
+	TLSConfig           *tls.Config
+	TLSHandshakeTimeout time.Duration
+
 	DoHijackCloserFactory DoHijackCloserFactory
 }
 
+var defaultDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
 var DefaultHijackableClient HijackableClient = &BasicHijackableClient{
-	Dial: (&net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}).Dial,
+	Dial:                  defaultDialer.Dial,
+	DialContext:           defaultDialer.DialContext,
 	DoHijackCloserFactory: DefaultDoHijackCloserFactory,
 }
 
+// Do sends the request on a new connection. If the request's context is
+// canceled before the response arrives, the connection is closed and the
+// context's error returned; once Do returned, the connection is no longer
+// tied to the context.
 func (c *BasicHijackableClient) Do(req *http.Request) (*http.Response, HijackCloser, error) {
-	conn, err := c.Dial("tcp", canonicalAddr(req.URL))
+	ctx := req.Context()
+
+	network, addr, err := c.address(req.URL)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	conn, err := c.dialTarget(ctx, req, network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if req.URL.Scheme == UnixSocketScheme {
+		// the host is the socket's path, which makes no sense to the server
+		req = attemptRequest(req)
+		req.Host = "localhost"
+	}
+
+	if req.URL.Scheme == "https" {
+		config := c.tlsConfig()
+		if config.ServerName == "" {
+			config.ServerName = req.URL.Hostname()
+		}
+
+		conn, err = c.handshake(ctx, conn, config)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	client := c.DoHijackCloserFactory.NewDoHijackCloser(conn, nil)
 
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
 	httpResp, err := client.Do(req)
+	if !stop() {
+		client.Close()
+		return nil, nil, ctx.Err()
+	}
+
 	if err != nil {
 		client.Close()
 		return nil, nil, err
@@ -90,8 +161,83 @@ func (c *BasicHijackableClient) Do(req *http.Request) (*http.Response, HijackClo
 	return httpResp, client, nil
 }
 
+// Direct reports whether the request is sent to the host of its URL, which
+// is not the case when dialing SocketPath or an http+unix URL.
+func (c *BasicHijackableClient) Direct(req *http.Request) bool {
+	return c.SocketPath == "" && req.URL.Scheme != UnixSocketScheme
+}
+
+func (c *BasicHijackableClient) address(u *url.URL) (network string, addr string, err error) {
+	if c.SocketPath != "" {
+		return "unix", c.SocketPath, nil
+	}
+
+	if u.Scheme == UnixSocketScheme {
+		socketPath, err := url.PathUnescape(u.Host)
+		if err != nil {
+			return "", "", err
+		}
+		return "unix", socketPath, nil
+	}
+
+	return "tcp", canonicalAddr(u), nil
+}
+
+func (c *BasicHijackableClient) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.DialContext != nil {
+		return c.DialContext(ctx, network, addr)
+	}
+
+	return c.Dial(network, addr)
+}
+
+// UnixSocketScheme is the scheme of URLs addressing a server listening on a
+// unix socket, whose path, escaped with url.PathEscape, is the URL's host.
+const UnixSocketScheme = "http+unix"
+
+// UnixSocketURL returns the URL for the path on the server listening on the
+// unix socket. Since url.Parse rejects escaped slashes in hosts, such URLs
+// have to be built rather than parsed.
+func UnixSocketURL(socketPath string, path string) *url.URL {
+	return &url.URL{
+		Scheme: UnixSocketScheme,
+		Host:   url.PathEscape(socketPath),
+		Path:   path,
+	}
+}
+
+// tlsConfig returns a copy of TLSConfig to be modified for a connection.
+func (c *BasicHijackableClient) tlsConfig() *tls.Config {
+	if c.TLSConfig == nil {
+		return &tls.Config{}
+	}
+
+	return c.TLSConfig.Clone()
+}
+
+func (c *BasicHijackableClient) handshake(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error) {
+	timeout := c.TLSHandshakeTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
 var portMap = map[string]string{
-	"http": "80",
+	"http":    "80",
+	"https":   "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
 }
 
 // canonicalAddr returns url.Host but always with a ":port" suffix
@@ -1,9 +1,18 @@
 package retryhttp_test
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"io"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"time"
 
 	"github.com/concourse/retryhttp"
 	"github.com/concourse/retryhttp/retryhttpfakes"
@@ -153,6 +162,262 @@ var _ = Describe("BasicHijackableClient", func() {
 				Expect(actualResponse).To(Equal(response))
 				Expect(actualHijackCloser).To(Equal(fakeDoHijackCloser))
 			})
+
+			It("keeps the connection open when the context is canceled afterwards", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				_, _, err := hijackableClient.Do(request.WithContext(ctx))
+				Expect(err).NotTo(HaveOccurred())
+
+				cancel()
+				Consistently(fakeConn.CloseCallCount).Should(BeZero())
+			})
+		})
+
+		Context("when the context is canceled while making the http request", func() {
+			var closed chan struct{}
+
+			BeforeEach(func() {
+				closed = make(chan struct{})
+				fakeConn.CloseStub = func() error {
+					close(closed)
+					return nil
+				}
+				fakeDoHijackCloser.DoStub = func(*http.Request) (*http.Response, error) {
+					<-closed
+					return nil, net.ErrClosed
+				}
+			})
+
+			It("closes the connection and returns the context's error", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(10*time.Millisecond, cancel)
+
+				_, _, err := hijackableClient.Do(request.WithContext(ctx))
+				Expect(err).To(Equal(context.Canceled))
+				Expect(fakeConn.CloseCallCount()).To(Equal(1))
+				Expect(fakeDoHijackCloser.CloseCallCount()).To(Equal(1))
+			})
+		})
+	})
+
+	Context("when dialing with a context", func() {
+		It("dials with the request's context", func() {
+			type key struct{}
+			ctx := context.WithValue(context.Background(), key{}, "value")
+
+			var dialedCtx context.Context
+			hijackableClient = &retryhttp.BasicHijackableClient{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					dialedCtx = ctx
+					return nil, errors.New("oh no")
+				},
+				DoHijackCloserFactory: fakeDoHijackCloserFactory,
+			}
+
+			request, err := http.NewRequestWithContext(ctx, "GET", "http://example.com", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = hijackableClient.Do(request)
+			Expect(err).To(MatchError("oh no"))
+			Expect(dialedCtx.Value(key{})).To(Equal("value"))
+		})
+	})
+})
+
+var _ = Describe("BasicHijackableClient over TLS", func() {
+	var (
+		server           *httptest.Server
+		dialer           *net.Dialer
+		hijackableClient *retryhttp.BasicHijackableClient
+		request          *http.Request
+		clientCerts      chan []*x509.Certificate
+	)
+
+	BeforeEach(func() {
+		clientCerts = make(chan []*x509.Certificate, 1)
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientCerts <- r.TLS.PeerCertificates
+			w.WriteHeader(http.StatusTeapot)
+		}))
+		server.Config.ErrorLog = log.New(io.Discard, "", 0)
+
+		dialer = &net.Dialer{}
+		hijackableClient = &retryhttp.BasicHijackableClient{
+			DialContext:           dialer.DialContext,
+			DoHijackCloserFactory: retryhttp.DefaultDoHijackCloserFactory,
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	trustServer := func() {
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+		hijackableClient.TLSConfig = &tls.Config{RootCAs: roots}
+
+		var err error
+		request, err = http.NewRequest("GET", server.URL, nil)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	Context("when the server is trusted", func() {
+		BeforeEach(func() {
+			server.StartTLS()
+			trustServer()
+		})
+
+		It("sends the request over TLS", func() {
+			response, hijackCloser, err := hijackableClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer hijackCloser.Close()
+
+			Expect(response.StatusCode).To(Equal(http.StatusTeapot))
+
+			conn, _ := hijackCloser.Hijack()
+			defer conn.Close()
+			Expect(conn).To(BeAssignableToTypeOf(&tls.Conn{}))
+			Expect(conn.(*tls.Conn).ConnectionState().HandshakeComplete).To(BeTrue())
+		})
+	})
+
+	Context("when the server requests a client certificate", func() {
+		var clientCert tls.Certificate
+
+		BeforeEach(func() {
+			server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+			server.StartTLS()
+			trustServer()
+
+			clientCert = generateCertificate(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+			hijackableClient.TLSConfig.Certificates = []tls.Certificate{clientCert}
+		})
+
+		It("presents the configured one", func() {
+			_, hijackCloser, err := hijackableClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer hijackCloser.Close()
+
+			var received []*x509.Certificate
+			Eventually(clientCerts).Should(Receive(&received))
+			Expect(received).To(HaveLen(1))
+			Expect(received[0].Raw).To(Equal(clientCert.Leaf.Raw))
+		})
+	})
+
+	Context("when the server is not trusted", func() {
+		BeforeEach(func() {
+			server.StartTLS()
+			trustServer()
+			hijackableClient.TLSConfig = nil
+		})
+
+		It("fails with a certificate error", func() {
+			_, _, err := hijackableClient.Do(request)
+			Expect(retryhttp.Classify(err)).To(Equal(retryhttp.CategoryCertificate))
+		})
+	})
+
+	Context("when the handshake times out", func() {
+		BeforeEach(func() {
+			server.Listener = stallingListener{server.Listener}
+			server.StartTLS()
+			trustServer()
+			hijackableClient.TLSHandshakeTimeout = 10 * time.Millisecond
+		})
+
+		It("fails with a timeout error", func() {
+			_, _, err := hijackableClient.Do(request)
+			Expect(err).To(HaveOccurred())
+			Expect(retryhttp.Classify(err)).To(Equal(retryhttp.CategoryTimeout))
+		})
+	})
+
+	Context("when the url has no port", func() {
+		It("uses port 443", func() {
+			var actualAddr string
+			hijackableClient.DialContext = func(_ context.Context, _, addr string) (net.Conn, error) {
+				actualAddr = addr
+				return nil, errors.New("oh no")
+			}
+
+			request, err := http.NewRequest("GET", "https://example.com", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			hijackableClient.Do(request)
+			Expect(actualAddr).To(Equal("example.com:443"))
+		})
+	})
+})
+
+var _ = Describe("BasicHijackableClient over a unix socket", func() {
+	var (
+		socketPath       string
+		server           *http.Server
+		hosts            chan string
+		hijackableClient *retryhttp.BasicHijackableClient
+	)
+
+	BeforeEach(func() {
+		socketPath = filepath.Join(GinkgoT().TempDir(), "garden.sock")
+		listener, err := net.Listen("unix", socketPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		hosts = make(chan string, 1)
+		server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hosts <- r.Host
+			w.WriteHeader(http.StatusTeapot)
+		})}
+		go server.Serve(listener)
+
+		hijackableClient = &retryhttp.BasicHijackableClient{
+			DialContext:           (&net.Dialer{}).DialContext,
+			DoHijackCloserFactory: retryhttp.DefaultDoHijackCloserFactory,
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	doRequest := func(request *http.Request) {
+		response, hijackCloser, err := hijackableClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer hijackCloser.Close()
+
+		Expect(response.StatusCode).To(Equal(http.StatusTeapot))
+
+		conn, _ := hijackCloser.Hijack()
+		defer conn.Close()
+		Expect(conn).To(BeAssignableToTypeOf(&net.UnixConn{}))
+	}
+
+	Context("when a socket path is configured", func() {
+		BeforeEach(func() {
+			hijackableClient.SocketPath = socketPath
+		})
+
+		It("sends requests to it", func() {
+			request, err := http.NewRequest("GET", "http://garden/containers", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			doRequest(request)
+			Expect(hosts).To(Receive(Equal("garden")))
+		})
+	})
+
+	Context("when the url addresses a unix socket", func() {
+		It("sends the request to it", func() {
+			request := &http.Request{
+				Method: "GET",
+				URL:    retryhttp.UnixSocketURL(socketPath, "/containers"),
+				Header: http.Header{},
+			}
+
+			doRequest(request)
+			Expect(hosts).To(Receive(Equal("localhost")))
+			Expect(request.URL.Host).To(Equal(url.PathEscape(socketPath)))
 		})
 	})
 })
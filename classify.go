@@ -0,0 +1,278 @@
+package retryhttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/http2"
+)
+
+// ErrorCategory describes the kind of failure behind an error returned by a
+// RoundTripper or HijackableClient.
+type ErrorCategory string
+
+const (
+	CategoryDNS         ErrorCategory = "dns"
+	CategoryConnect     ErrorCategory = "connect"
+	CategoryTLS         ErrorCategory = "tls"
+	CategoryCertificate ErrorCategory = "certificate"
+	CategoryTimeout     ErrorCategory = "timeout"
+	CategoryReset       ErrorCategory = "reset"
+	CategoryProtocol    ErrorCategory = "protocol"
+	CategoryPermanent   ErrorCategory = "permanent"
+
+	// CategoryUnprocessed is for failures where the server guarantees it did
+	// not process the request, such as an HTTP/2 REFUSED_STREAM. These are
+	// safe to retry regardless of the method, even if the request body was
+	// already sent, as long as the body can be rewound.
+	CategoryUnprocessed ErrorCategory = "unprocessed"
+)
+
+// Retryable reports whether errors of this category are worth retrying.
+func (c ErrorCategory) Retryable() bool {
+	switch c {
+	case CategoryDNS, CategoryConnect, CategoryTLS, CategoryTimeout, CategoryReset, CategoryUnprocessed:
+		return true
+	default:
+		return false
+	}
+}
+
+// TLS alerts sent by a peer that rejected our certificate. Retrying will not
+// make the peer change its mind.
+var certificateAlerts = []tls.AlertError{
+	42,  // bad_certificate
+	43,  // unsupported_certificate
+	44,  // certificate_revoked
+	45,  // certificate_expired
+	46,  // certificate_unknown
+	48,  // unknown_ca
+	116, // certificate_required
+}
+
+// TLS alerts sent by a peer that shares no protocol version or cipher suite
+// with us. Retrying will negotiate the same way.
+var negotiationAlerts = []tls.AlertError{
+	40, // handshake_failure
+	70, // protocol_version
+}
+
+// Syscall error codes raised while establishing a connection
+var connectSyscallErrors = []syscall.Errno{
+	syscall.ECONNREFUSED, // Connection refused - The server is not listening on the specified port
+	syscall.EHOSTUNREACH, // No route to host
+	syscall.ENETUNREACH,  // Network is unreachable
+}
+
+// Syscall error codes raised when an established connection is torn down
+var resetSyscallErrors = []syscall.Errno{
+	syscall.ECONNRESET,   // Connection reset by peer - The server abruptly closed the connection
+	syscall.ECONNABORTED, // Software caused connection abort
+	syscall.EPIPE,        // Broken pipe - Attempt to write to a socket that has been closed by the peer
+}
+
+// Classify inspects the error chain and returns the category of the failure.
+// Errors that are not recognized are CategoryPermanent. Certificate
+// verification failures, on either side of the connection, are
+// CategoryCertificate and are never retryable.
+func Classify(err error) ErrorCategory {
+	if err == nil {
+		return CategoryPermanent
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Err != nil {
+		return Classify(urlErr.Err)
+	}
+
+	if category, ok := classifyTLS(err); ok {
+		return category
+	}
+
+	if category, ok := classifyHTTP2(err); ok {
+		return category
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsTimeout:
+			return CategoryTimeout
+		case dnsErr.IsNotFound, dnsErr.IsTemporary:
+			return CategoryDNS
+		default:
+			return CategoryPermanent
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return CategoryTimeout
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if slices.Contains(connectSyscallErrors, errno) {
+			return CategoryConnect
+		}
+		if slices.Contains(resetSyscallErrors, errno) {
+			return CategoryReset
+		}
+	}
+
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.EOF),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, http.ErrBodyReadAfterClose):
+		return CategoryReset
+	}
+
+	var protocolErr textproto.ProtocolError
+	if errors.As(err, &protocolErr) {
+		return CategoryProtocol
+	}
+
+	return CategoryPermanent
+}
+
+func classifyTLS(err error) (ErrorCategory, bool) {
+	var recordHeaderErr tls.RecordHeaderError
+	if errors.As(err, &recordHeaderErr) {
+		// the peer is not speaking TLS at all
+		return CategoryProtocol, true
+	}
+
+	var (
+		verificationErr     *tls.CertificateVerificationError
+		unknownAuthorityErr x509.UnknownAuthorityError
+		hostnameErr         x509.HostnameError
+		invalidErr          x509.CertificateInvalidError
+	)
+	if errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) {
+		return CategoryCertificate, true
+	}
+
+	var alertErr tls.AlertError
+	if errors.As(err, &alertErr) {
+		if slices.Contains(certificateAlerts, alertErr) {
+			return CategoryCertificate, true
+		}
+		if slices.Contains(negotiationAlerts, alertErr) {
+			return CategoryProtocol, true
+		}
+		return CategoryTLS, true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		// alerts sent by the peer are not exported as tls.AlertError, but
+		// share its messages
+		for _, alert := range certificateAlerts {
+			if opErr.Err != nil && opErr.Err.Error() == alert.Error() {
+				return CategoryCertificate, true
+			}
+		}
+		for _, alert := range negotiationAlerts {
+			if opErr.Err != nil && opErr.Err.Error() == alert.Error() {
+				return CategoryProtocol, true
+			}
+		}
+		return CategoryTLS, true
+	}
+
+	return "", false
+}
+
+var (
+	// net/http bundles its own HTTP/2 implementation whose GOAWAY and
+	// connection errors are unexported, so they can only be recognized by
+	// their messages.
+	http2GoAwayMessage      = regexp.MustCompile(`http2: server sent GOAWAY and closed the connection; LastStreamID=(\d+), ErrCode=(\w+)`)
+	http2StreamErrorMessage = regexp.MustCompile(`stream error: stream ID \d+; (\w+)`)
+)
+
+const (
+	http2GracefulGoAwayMessage  = "http2: Transport received Server's graceful shutdown GOAWAY"
+	http2ConnectionLostMessage  = "http2: client connection lost"
+	http2ClientConnUnusableText = "http2: client conn not usable"
+)
+
+func classifyHTTP2(err error) (ErrorCategory, bool) {
+	var streamErr http2.StreamError
+	if errors.As(err, &streamErr) {
+		return classifyHTTP2ErrCode(streamErr.Code.String()), true
+	}
+
+	var goAwayErr http2.GoAwayError
+	if errors.As(err, &goAwayErr) {
+		return classifyHTTP2GoAway(goAwayErr.LastStreamID, goAwayErr.ErrCode.String()), true
+	}
+
+	var connErr http2.ConnectionError
+	if errors.As(err, &connErr) {
+		return CategoryProtocol, true
+	}
+
+	msg := err.Error()
+
+	if match := http2GoAwayMessage.FindStringSubmatch(msg); match != nil {
+		lastStreamID, _ := strconv.ParseUint(match[1], 10, 32)
+		return classifyHTTP2GoAway(uint32(lastStreamID), match[2]), true
+	}
+
+	if match := http2StreamErrorMessage.FindStringSubmatch(msg); match != nil {
+		return classifyHTTP2ErrCode(match[1]), true
+	}
+
+	switch {
+	case strings.Contains(msg, http2GracefulGoAwayMessage),
+		strings.Contains(msg, http2ClientConnUnusableText):
+		return CategoryUnprocessed, true
+	case strings.Contains(msg, http2ConnectionLostMessage):
+		return CategoryReset, true
+	}
+
+	return "", false
+}
+
+// classifyHTTP2GoAway classifies a GOAWAY that closed the connection while a
+// request was in flight. Streams above LastStreamID were not processed, but
+// the request's stream ID is unknown here, so only a LastStreamID of 0 proves
+// the request was not processed.
+func classifyHTTP2GoAway(lastStreamID uint32, code string) ErrorCategory {
+	if lastStreamID == 0 {
+		return CategoryUnprocessed
+	}
+
+	return classifyHTTP2ErrCode(code)
+}
+
+func classifyHTTP2ErrCode(code string) ErrorCategory {
+	switch code {
+	case http2.ErrCodeRefusedStream.String():
+		return CategoryUnprocessed
+	case http2.ErrCodeProtocol.String(),
+		http2.ErrCodeFrameSize.String(),
+		http2.ErrCodeCompression.String(),
+		http2.ErrCodeFlowControl.String(),
+		http2.ErrCodeHTTP11Required.String():
+		return CategoryProtocol
+	default:
+		return CategoryReset
+	}
+}
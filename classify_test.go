@@ -0,0 +1,294 @@
+package retryhttp_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/concourse/retryhttp"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+var _ = Describe("Classify", func() {
+	DescribeTable("categorizes errors",
+		func(err error, category retryhttp.ErrorCategory) {
+			Expect(retryhttp.Classify(err)).To(Equal(category))
+		},
+		Entry("dns not found", &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}, retryhttp.CategoryDNS),
+		Entry("dns temporary", &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, retryhttp.CategoryDNS),
+		Entry("dns timeout", &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, retryhttp.CategoryTimeout),
+		Entry("dns failure", &net.DNSError{Err: "invalid name", Name: "example..com"}, retryhttp.CategoryPermanent),
+		Entry("connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, retryhttp.CategoryConnect),
+		Entry("no route to host", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, retryhttp.CategoryConnect),
+		Entry("connection reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, retryhttp.CategoryReset),
+		Entry("broken pipe", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, retryhttp.CategoryReset),
+		Entry("operation timed out", syscall.ETIMEDOUT, retryhttp.CategoryTimeout),
+		Entry("deadline exceeded", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, retryhttp.CategoryTimeout),
+		Entry("unexpected EOF", io.ErrUnexpectedEOF, retryhttp.CategoryReset),
+		Entry("closed connection", fmt.Errorf("read: %w", net.ErrClosed), retryhttp.CategoryReset),
+		Entry("read after close", http.ErrBodyReadAfterClose, retryhttp.CategoryReset),
+		Entry("tls alert from the peer", &net.OpError{Op: "remote error", Err: tls.AlertError(80)}, retryhttp.CategoryTLS),
+		Entry("handshake failure alert from the peer", &net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}, retryhttp.CategoryProtocol),
+		Entry("protocol version alert", tls.AlertError(70), retryhttp.CategoryProtocol),
+		Entry("tls alert", tls.AlertError(80), retryhttp.CategoryTLS),
+		Entry("unknown authority", &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, retryhttp.CategoryCertificate),
+		Entry("hostname mismatch", x509.HostnameError{Host: "example.com"}, retryhttp.CategoryCertificate),
+		Entry("expired certificate", x509.CertificateInvalidError{Reason: x509.Expired}, retryhttp.CategoryCertificate),
+		Entry("bad certificate alert from the peer", &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}, retryhttp.CategoryCertificate),
+		Entry("certificate required alert", tls.AlertError(116), retryhttp.CategoryCertificate),
+		Entry("not speaking tls", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, retryhttp.CategoryProtocol),
+		Entry("malformed response", textproto.ProtocolError("malformed MIME header line"), retryhttp.CategoryProtocol),
+		Entry("url error", &url.Error{Op: "Get", URL: "http://example.com", Err: syscall.ECONNRESET}, retryhttp.CategoryReset),
+		Entry("http2 refused stream", http2.StreamError{StreamID: 3, Code: http2.ErrCodeRefusedStream}, retryhttp.CategoryUnprocessed),
+		Entry("http2 internal error", http2.StreamError{StreamID: 3, Code: http2.ErrCodeInternal}, retryhttp.CategoryReset),
+		Entry("http2 protocol error", http2.StreamError{StreamID: 3, Code: http2.ErrCodeProtocol}, retryhttp.CategoryProtocol),
+		Entry("http2 GOAWAY before any stream", http2.GoAwayError{LastStreamID: 0, ErrCode: http2.ErrCodeNo}, retryhttp.CategoryUnprocessed),
+		Entry("http2 GOAWAY after some streams", http2.GoAwayError{LastStreamID: 5, ErrCode: http2.ErrCodeNo}, retryhttp.CategoryReset),
+		Entry("http2 connection error", http2.ConnectionError(http2.ErrCodeProtocol), retryhttp.CategoryProtocol),
+		Entry("bundled http2 GOAWAY", errors.New(`http2: server sent GOAWAY and closed the connection; LastStreamID=1, ErrCode=NO_ERROR, debug=""`), retryhttp.CategoryReset),
+		Entry("bundled http2 GOAWAY before any stream", errors.New(`http2: server sent GOAWAY and closed the connection; LastStreamID=0, ErrCode=NO_ERROR, debug=""`), retryhttp.CategoryUnprocessed),
+		Entry("bundled http2 graceful GOAWAY", errors.New("http2: Transport received Server's graceful shutdown GOAWAY"), retryhttp.CategoryUnprocessed),
+		Entry("bundled http2 refused stream", errors.New("http2: Transport: cannot retry err [stream error: stream ID 1; REFUSED_STREAM] after Request.Body was written; define Request.GetBody to avoid this error"), retryhttp.CategoryUnprocessed),
+		Entry("http2 client connection lost", errors.New("http2: client connection lost"), retryhttp.CategoryReset),
+		Entry("unknown error", errors.New("oh no"), retryhttp.CategoryPermanent),
+		Entry("unknown error mentioning a timeout", errors.New("i/o timeout"), retryhttp.CategoryPermanent),
+		Entry("no error", nil, retryhttp.CategoryPermanent),
+	)
+
+	Context("with errors from real connections", func() {
+		var listener net.Listener
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("classifies refused connections", func() {
+			addr := listener.Addr().String()
+			listener.Close()
+
+			_, err := net.Dial("tcp", addr)
+			Expect(err).To(HaveOccurred())
+			Expect(retryhttp.Classify(err)).To(Equal(retryhttp.CategoryConnect))
+		})
+
+		It("classifies reset connections", func() {
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*net.TCPConn).SetLinger(0)
+				conn.Close()
+			}()
+
+			_, err := http.Get("http://" + listener.Addr().String())
+			Expect(err).To(HaveOccurred())
+			Expect(retryhttp.Classify(err)).To(Equal(retryhttp.CategoryReset))
+		})
+
+		It("classifies timeouts", func() {
+			client := &http.Client{Timeout: 10 * time.Millisecond}
+
+			_, err := client.Get("http://" + listener.Addr().String())
+			Expect(err).To(HaveOccurred())
+			Expect(retryhttp.Classify(err)).To(Equal(retryhttp.CategoryTimeout))
+		})
+	})
+})
+
+var _ = Describe("Classify with a local HTTP/2 server", func() {
+	var (
+		server    *rawHTTP2Server
+		transport *http.Transport
+	)
+
+	BeforeEach(func() {
+		server = newRawHTTP2Server()
+		transport = server.Transport()
+	})
+
+	AfterEach(func() {
+		transport.CloseIdleConnections()
+		server.Close()
+	})
+
+	It("classifies refused streams as unprocessed", func() {
+		server.HandleStream = func(framer *http2.Framer, streamID uint32) bool {
+			Expect(framer.WriteRSTStream(streamID, http2.ErrCodeRefusedStream)).To(Succeed())
+			return true
+		}
+
+		// without GetBody, the transport can not retry the request itself
+		request, err := http.NewRequest("POST", server.URL(), io.NopCloser(strings.NewReader("hello")))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = transport.RoundTrip(request)
+		Expect(err).To(MatchError(ContainSubstring("REFUSED_STREAM")))
+		Expect(retryhttp.Classify(err)).To(Equal(retryhttp.CategoryUnprocessed))
+	})
+
+	It("classifies a GOAWAY closing an in-flight stream as a reset", func() {
+		server.HandleStream = func(framer *http2.Framer, streamID uint32) bool {
+			Expect(framer.WriteGoAway(streamID, http2.ErrCodeNo, nil)).To(Succeed())
+			return false
+		}
+
+		request, err := http.NewRequest("GET", server.URL(), nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = transport.RoundTrip(request)
+		Expect(err).To(MatchError(ContainSubstring("server sent GOAWAY")))
+		Expect(retryhttp.Classify(err)).To(Equal(retryhttp.CategoryReset))
+	})
+})
+
+var _ = Describe("DefaultRetryer", func() {
+	var retryer *retryhttp.DefaultRetryer
+
+	BeforeEach(func() {
+		retryer = &retryhttp.DefaultRetryer{}
+	})
+
+	It("retries retryable categories with the category as the reason", func() {
+		decision := retryer.Decide(syscall.ECONNREFUSED)
+		Expect(decision.Retry).To(BeTrue())
+		Expect(decision.Reason).To(Equal("connect"))
+		Expect(decision.Category).To(Equal(retryhttp.CategoryConnect))
+		Expect(retryer.IsRetryable(syscall.ECONNREFUSED)).To(BeTrue())
+	})
+
+	It("does not retry permanent errors", func() {
+		decision := retryer.Decide(errors.New("oh no"))
+		Expect(decision.Retry).To(BeFalse())
+		Expect(decision.Category).To(Equal(retryhttp.CategoryPermanent))
+		Expect(retryer.IsRetryable(errors.New("oh no"))).To(BeFalse())
+	})
+
+	It("does not retry without an error", func() {
+		Expect(retryer.IsRetryable(nil)).To(BeFalse())
+	})
+})
+
+// rawHTTP2Server speaks just enough HTTP/2 over TLS to misbehave in ways
+// net/http's server never does.
+type rawHTTP2Server struct {
+	listener    net.Listener
+	certificate tls.Certificate
+
+	// HandleStream is called for every request. It returns false to close
+	// the connection.
+	HandleStream func(framer *http2.Framer, streamID uint32) bool
+}
+
+func newRawHTTP2Server() *rawHTTP2Server {
+	certificate := generateCertificate(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		NextProtos:   []string{http2.NextProtoTLS},
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	server := &rawHTTP2Server{listener: listener, certificate: certificate}
+	go server.serve()
+
+	return server
+}
+
+func (s *rawHTTP2Server) URL() string {
+	return "https://" + s.listener.Addr().String()
+}
+
+func (s *rawHTTP2Server) Transport() *http.Transport {
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(s.certificate.Leaf)
+
+	return &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: rootCAs},
+		ForceAttemptHTTP2: true,
+	}
+}
+
+func (s *rawHTTP2Server) Close() {
+	s.listener.Close()
+}
+
+func (s *rawHTTP2Server) serve() {
+	defer GinkgoRecover()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *rawHTTP2Server) serveConn(conn net.Conn) {
+	defer GinkgoRecover()
+	defer conn.Close()
+
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		return
+	}
+
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		return
+	}
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		switch frame := frame.(type) {
+		case *http2.SettingsFrame:
+			if !frame.IsAck() {
+				framer.WriteSettingsAck()
+			}
+		case *http2.HeadersFrame:
+			if !s.HandleStream(framer, frame.StreamID) {
+				return
+			}
+		}
+	}
+}
+
+func writeHTTP2Response(framer *http2.Framer, streamID uint32, status int) {
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	Expect(encoder.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(status)})).To(Succeed())
+
+	Expect(framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: block.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})).To(Succeed())
+}
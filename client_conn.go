@@ -0,0 +1,131 @@
+package retryhttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// maxResponseHeaderBytes bounds the size of a response's status line and
+// headers, including those of informational responses.
+const maxResponseHeaderBytes = 1 << 20
+
+// ErrHijacked is returned by Do once the connection was hijacked or closed.
+var ErrHijacked = errors.New("connection hijacked or closed")
+
+// clientConn is a DoHijackCloser sending one request at a time over a
+// connection that can be taken over once a response arrived.
+type clientConn struct {
+	conn   net.Conn
+	limit  *limitedReader
+	reader *bufio.Reader
+
+	lock     sync.Mutex
+	hijacked bool
+}
+
+// newClientConn returns a clientConn reading from r, if given, or from the
+// connection itself.
+func newClientConn(c net.Conn, r *bufio.Reader) *clientConn {
+	var source io.Reader = c
+	if r != nil {
+		source = r
+	}
+
+	limit := &limitedReader{reader: source, remaining: -1}
+
+	return &clientConn{
+		conn:   c,
+		limit:  limit,
+		reader: bufio.NewReader(limit),
+	}
+}
+
+// Do writes the request and reads its response, skipping informational
+// responses other than 101 Switching Protocols. The body of the previous
+// response must have been read before sending another request.
+func (c *clientConn) Do(req *http.Request) (*http.Response, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.hijacked {
+		return nil, ErrHijacked
+	}
+
+	if err := req.Write(c.conn); err != nil {
+		return nil, err
+	}
+
+	for {
+		c.limit.remaining = maxResponseHeaderBytes
+		response, err := http.ReadResponse(c.reader, req)
+		exceeded := c.limit.remaining == 0
+		c.limit.remaining = -1
+
+		if err != nil {
+			if exceeded {
+				return nil, fmt.Errorf("response headers exceeded %d bytes", maxResponseHeaderBytes)
+			}
+			return nil, err
+		}
+
+		if response.StatusCode >= 100 && response.StatusCode < 200 && response.StatusCode != http.StatusSwitchingProtocols {
+			continue
+		}
+
+		return response, nil
+	}
+}
+
+// Hijack hands over the connection along with the reader holding any bytes
+// that were read from it but not consumed yet.
+func (c *clientConn) Hijack() (net.Conn, *bufio.Reader) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.hijacked = true
+
+	return c.conn, c.reader
+}
+
+// Close closes the connection, unless it was hijacked, in which case closing
+// it is up to the caller of Hijack.
+func (c *clientConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.hijacked {
+		return nil
+	}
+	c.hijacked = true
+
+	return c.conn.Close()
+}
+
+// limitedReader fails reads once remaining bytes were read, unless remaining
+// is negative.
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	if r.remaining > 0 && int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.reader.Read(p)
+	if r.remaining > 0 {
+		r.remaining -= int64(n)
+	}
+
+	return n, err
+}
@@ -0,0 +1,141 @@
+package retryhttp_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/concourse/retryhttp"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DefaultDoHijackCloserFactory", func() {
+	var (
+		clientConn     net.Conn
+		serverConn     net.Conn
+		requests       chan *http.Request
+		doHijackCloser retryhttp.DoHijackCloser
+		request        *http.Request
+	)
+
+	// respond reads a request from the client and answers it with the raw
+	// response
+	respond := func(rawResponse string) {
+		go func() {
+			request, err := http.ReadRequest(bufio.NewReader(serverConn))
+			if err != nil {
+				return
+			}
+			body, _ := io.ReadAll(request.Body)
+			request.Body = io.NopCloser(strings.NewReader(string(body)))
+			requests <- request
+
+			io.WriteString(serverConn, rawResponse)
+		}()
+	}
+
+	BeforeEach(func() {
+		clientConn, serverConn = net.Pipe()
+		requests = make(chan *http.Request, 1)
+		doHijackCloser = retryhttp.DefaultDoHijackCloserFactory.NewDoHijackCloser(clientConn, nil)
+
+		var err error
+		request, err = http.NewRequest("POST", "http://garden/containers", strings.NewReader("hello"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	It("writes the request and reads the response", func() {
+		respond("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nworld")
+
+		response, err := doHijackCloser.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(io.ReadAll(response.Body)).To(Equal([]byte("world")))
+
+		var received *http.Request
+		Expect(requests).To(Receive(&received))
+		Expect(received.Method).To(Equal("POST"))
+		Expect(received.URL.Path).To(Equal("/containers"))
+		Expect(received.Host).To(Equal("garden"))
+		Expect(io.ReadAll(received.Body)).To(Equal([]byte("hello")))
+	})
+
+	It("decodes chunked responses", func() {
+		respond("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+
+		response, err := doHijackCloser.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(io.ReadAll(response.Body)).To(Equal([]byte("hello world")))
+	})
+
+	It("skips informational responses", func() {
+		respond("HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n" +
+			"HTTP/1.1 204 No Content\r\n\r\n")
+
+		response, err := doHijackCloser.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusNoContent))
+	})
+
+	It("returns 101 Switching Protocols responses", func() {
+		respond("HTTP/1.1 101 Switching Protocols\r\nUpgrade: tcp\r\nConnection: Upgrade\r\n\r\nraw stream")
+
+		response, err := doHijackCloser.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+	})
+
+	It("hands back the connection with the bytes read ahead", func() {
+		respond("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nworldraw stream")
+
+		response, err := doHijackCloser.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(io.ReadAll(response.Body)).To(Equal([]byte("world")))
+
+		conn, reader := doHijackCloser.Hijack()
+		Expect(conn).To(Equal(clientConn))
+
+		buf := make([]byte, len("raw stream"))
+		_, err = io.ReadFull(reader, buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(buf)).To(Equal("raw stream"))
+
+		_, err = doHijackCloser.Do(request)
+		Expect(err).To(MatchError(retryhttp.ErrHijacked))
+	})
+
+	It("fails when the response headers are too large", func() {
+		respond("HTTP/1.1 200 OK\r\nX-Huge: " + strings.Repeat("a", 2<<20) + "\r\n\r\n")
+
+		_, err := doHijackCloser.Do(request)
+		Expect(err).To(MatchError(ContainSubstring("response headers exceeded")))
+	})
+
+	It("leaves a hijacked connection open when closed", func() {
+		conn, _ := doHijackCloser.Hijack()
+		Expect(doHijackCloser.Close()).To(Succeed())
+
+		go io.WriteString(serverConn, "still here")
+
+		buf := make([]byte, len("still here"))
+		_, err := io.ReadFull(conn, buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(buf)).To(Equal("still here"))
+	})
+
+	It("closes the connection", func() {
+		Expect(doHijackCloser.Close()).To(Succeed())
+
+		_, err := clientConn.Write([]byte("x"))
+		Expect(err).To(MatchError(io.ErrClosedPipe))
+	})
+})
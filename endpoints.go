@@ -0,0 +1,166 @@
+package retryhttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+//counterfeiter:generate . Endpoints
+
+// Endpoints picks which of several equivalent servers each attempt is sent
+// to. Every endpoint returned by Next is passed to Report once the attempt is
+// over, along with the error that made it fail, whether it is going to be
+// retried or not, or nil if it succeeded. Responses with a 5xx status count
+// as failures, while attempts ended by the request's context say nothing
+// about the endpoint and are reported with nil. An attempt whose response is
+// returned is only over once the response body is closed.
+type Endpoints interface {
+	Next() *url.URL
+	Report(endpoint *url.URL, err error)
+}
+
+// EndpointOrder determines the order in which FailoverEndpoints are tried.
+type EndpointOrder int
+
+const (
+	// RoundRobin spreads requests across all healthy endpoints.
+	RoundRobin EndpointOrder = iota
+	// Priority always prefers the earliest healthy endpoint in the list.
+	Priority
+)
+
+// DefaultFailureTTL is how long FailoverEndpoints avoids an endpoint after a
+// failed attempt, unless configured otherwise.
+const DefaultFailureTTL = 30 * time.Second
+
+// FailoverEndpoints is an Endpoints over a fixed list of URLs, of which only
+// the scheme and host are used. Endpoints that recently failed are skipped
+// until FailureTTL has passed or they succeed again; if all of them failed,
+// the one that failed longest ago is tried.
+type FailoverEndpoints struct {
+	URLs       []*url.URL
+	Order      EndpointOrder
+	FailureTTL time.Duration
+
+	lock     sync.Mutex
+	next     int
+	failedAt map[string]time.Time
+}
+
+func (e *FailoverEndpoints) Next() *url.URL {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if len(e.URLs) == 0 {
+		return nil
+	}
+
+	start := 0
+	if e.Order == RoundRobin {
+		start = e.next
+		e.next = (e.next + 1) % len(e.URLs)
+	}
+
+	ttl := e.FailureTTL
+	if ttl == 0 {
+		ttl = DefaultFailureTTL
+	}
+
+	var oldest *url.URL
+	var oldestFailure time.Time
+
+	for i := range e.URLs {
+		endpoint := e.URLs[(start+i)%len(e.URLs)]
+
+		failedAt, failed := e.failedAt[endpointKey(endpoint)]
+		if !failed || time.Since(failedAt) >= ttl {
+			return endpoint
+		}
+
+		if oldest == nil || failedAt.Before(oldestFailure) {
+			oldest, oldestFailure = endpoint, failedAt
+		}
+	}
+
+	return oldest
+}
+
+func (e *FailoverEndpoints) Report(endpoint *url.URL, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if err == nil {
+		delete(e.failedAt, endpointKey(endpoint))
+		return
+	}
+
+	if e.failedAt == nil {
+		e.failedAt = map[string]time.Time{}
+	}
+	e.failedAt[endpointKey(endpoint)] = time.Now()
+}
+
+func endpointKey(endpoint *url.URL) string {
+	return endpoint.Scheme + "://" + endpoint.Host
+}
+
+// useEndpoint points the request at the endpoint's scheme and host.
+func useEndpoint(request *http.Request, endpoint *url.URL) {
+	request.URL.Scheme = endpoint.Scheme
+	request.URL.Host = endpoint.Host
+	request.Host = endpoint.Host
+}
+
+// attemptOutcome returns the error an attempt that ended with the response or
+// err is reported with.
+func attemptOutcome(request *http.Request, response *http.Response, err error) error {
+	switch {
+	case err != nil && request.Context().Err() != nil:
+		return nil
+	case err != nil:
+		return err
+	case response.StatusCode >= 500:
+		return fmt.Errorf("received status %d", response.StatusCode)
+	default:
+		return nil
+	}
+}
+
+// reportOnClose calls report once the response body is closed, or right away
+// if there is no body. A writable body, as returned with 101 Switching
+// Protocols, stays writable.
+func reportOnClose(response *http.Response, report func()) {
+	if response == nil || response.Body == nil {
+		report()
+		return
+	}
+
+	body := &reportingBody{ReadCloser: response.Body, report: report}
+	if writer, ok := response.Body.(io.Writer); ok {
+		response.Body = &writableReportingBody{reportingBody: body, Writer: writer}
+		return
+	}
+
+	response.Body = body
+}
+
+type reportingBody struct {
+	io.ReadCloser
+	once   sync.Once
+	report func()
+}
+
+func (b *reportingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.report)
+	return err
+}
+
+type writableReportingBody struct {
+	*reportingBody
+	io.Writer
+}
@@ -0,0 +1,242 @@
+package retryhttp_test
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/cenkalti/backoff/v5"
+	"github.com/concourse/retryhttp"
+	"github.com/concourse/retryhttp/retryhttpfakes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Endpoints", func() {
+	var (
+		fakeRoundTripper  *retryhttpfakes.FakeRoundTripper
+		fakeEndpoints     *retryhttpfakes.FakeEndpoints
+		retryRoundTripper *retryhttp.RetryRoundTripper
+		request           *http.Request
+		roundTripErr      error
+	)
+
+	BeforeEach(func() {
+		fakeRoundTripper = new(retryhttpfakes.FakeRoundTripper)
+		fakeBackOff := new(retryhttpfakes.FakeBackOff)
+		fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+		fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+		fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+		fakeEndpoints = new(retryhttpfakes.FakeEndpoints)
+		fakeEndpoints.NextReturnsOnCall(0, &url.URL{Scheme: "http", Host: "web-1:8080"})
+		fakeEndpoints.NextReturnsOnCall(1, &url.URL{Scheme: "https", Host: "web-2"})
+
+		retryRoundTripper = &retryhttp.RetryRoundTripper{
+			Logger:         lager.NewLogger("test"),
+			BackOffFactory: fakeBackOffFactory,
+			RoundTripper:   fakeRoundTripper,
+			Endpoints:      fakeEndpoints,
+		}
+
+		fakeRoundTripper.RoundTripReturnsOnCall(0, nil, syscall.ECONNREFUSED)
+		fakeRoundTripper.RoundTripReturnsOnCall(1, &http.Response{StatusCode: http.StatusOK}, nil)
+
+		var err error
+		request, err = http.NewRequest("GET", "http://atc/api/v1/info?x=1", nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		_, roundTripErr = retryRoundTripper.RoundTrip(request)
+	})
+
+	It("sends each attempt to the next endpoint", func() {
+		Expect(roundTripErr).NotTo(HaveOccurred())
+		Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+
+		first := fakeRoundTripper.RoundTripArgsForCall(0)
+		Expect(first.URL.String()).To(Equal("http://web-1:8080/api/v1/info?x=1"))
+		Expect(first.Host).To(Equal("web-1:8080"))
+
+		second := fakeRoundTripper.RoundTripArgsForCall(1)
+		Expect(second.URL.String()).To(Equal("https://web-2/api/v1/info?x=1"))
+		Expect(second.Host).To(Equal("web-2"))
+	})
+
+	It("reports the outcome of every attempt", func() {
+		Expect(fakeEndpoints.ReportCallCount()).To(Equal(2))
+
+		endpoint, err := fakeEndpoints.ReportArgsForCall(0)
+		Expect(endpoint.Host).To(Equal("web-1:8080"))
+		Expect(err).To(Equal(syscall.ECONNREFUSED))
+
+		endpoint, err = fakeEndpoints.ReportArgsForCall(1)
+		Expect(endpoint.Host).To(Equal("web-2"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("does not modify the caller's request", func() {
+		Expect(request.URL.String()).To(Equal("http://atc/api/v1/info?x=1"))
+		Expect(request.Host).To(Equal("atc"))
+	})
+
+	Context("when an attempt fails with an error that is not retried", func() {
+		BeforeEach(func() {
+			fakeRoundTripper.RoundTripReturnsOnCall(0, nil, x509.CertificateInvalidError{Reason: x509.Expired})
+		})
+
+		It("reports it as a failure", func() {
+			Expect(roundTripErr).To(HaveOccurred())
+			Expect(fakeEndpoints.ReportCallCount()).To(Equal(1))
+
+			_, err := fakeEndpoints.ReportArgsForCall(0)
+			Expect(err).To(Equal(x509.CertificateInvalidError{Reason: x509.Expired}))
+		})
+	})
+
+	Context("when a server error is returned without being retried", func() {
+		BeforeEach(func() {
+			fakeRoundTripper.RoundTripReturnsOnCall(1, &http.Response{StatusCode: http.StatusInternalServerError}, nil)
+		})
+
+		It("reports it as a failure", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeEndpoints.ReportCallCount()).To(Equal(2))
+
+			_, err := fakeEndpoints.ReportArgsForCall(1)
+			Expect(err).To(MatchError("received status 500"))
+		})
+	})
+})
+
+var _ = Describe("FailoverEndpoints", func() {
+	var (
+		urls      []*url.URL
+		endpoints *retryhttp.FailoverEndpoints
+		disaster  error
+	)
+
+	hosts := func(n int) []string {
+		var hosts []string
+		for range n {
+			hosts = append(hosts, endpoints.Next().Host)
+		}
+		return hosts
+	}
+
+	BeforeEach(func() {
+		urls = []*url.URL{
+			{Scheme: "http", Host: "web-1"},
+			{Scheme: "http", Host: "web-2"},
+			{Scheme: "http", Host: "web-3"},
+		}
+		endpoints = &retryhttp.FailoverEndpoints{URLs: urls}
+		disaster = errors.New("oh no!")
+	})
+
+	Context("in round-robin order", func() {
+		It("cycles through the endpoints", func() {
+			Expect(hosts(4)).To(Equal([]string{"web-1", "web-2", "web-3", "web-1"}))
+		})
+
+		It("skips endpoints that recently failed", func() {
+			endpoints.Report(urls[1], disaster)
+			Expect(hosts(3)).To(Equal([]string{"web-1", "web-3", "web-3"}))
+		})
+
+		It("uses endpoints again once they succeed", func() {
+			endpoints.Report(urls[1], disaster)
+			endpoints.Report(urls[1], nil)
+			Expect(hosts(3)).To(Equal([]string{"web-1", "web-2", "web-3"}))
+		})
+	})
+
+	Context("in priority order", func() {
+		BeforeEach(func() {
+			endpoints.Order = retryhttp.Priority
+		})
+
+		It("prefers the first endpoint", func() {
+			Expect(hosts(2)).To(Equal([]string{"web-1", "web-1"}))
+		})
+
+		It("fails over to the next healthy endpoint", func() {
+			endpoints.Report(urls[0], disaster)
+			Expect(hosts(2)).To(Equal([]string{"web-2", "web-2"}))
+
+			endpoints.Report(urls[1], disaster)
+			Expect(hosts(1)).To(Equal([]string{"web-3"}))
+		})
+
+		It("tries the endpoint that failed longest ago when all of them failed", func() {
+			endpoints.Report(urls[1], disaster)
+			endpoints.Report(urls[0], disaster)
+			endpoints.Report(urls[2], disaster)
+			Expect(hosts(1)).To(Equal([]string{"web-2"}))
+		})
+
+		Context("as the endpoints of a RetryRoundTripper", func() {
+			var (
+				fakeRoundTripper  *retryhttpfakes.FakeRoundTripper
+				retryRoundTripper *retryhttp.RetryRoundTripper
+				request           *http.Request
+			)
+
+			BeforeEach(func() {
+				fakeRoundTripper = new(retryhttpfakes.FakeRoundTripper)
+				fakeRoundTripper.RoundTripReturns(&http.Response{StatusCode: http.StatusOK}, nil)
+
+				fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+				fakeBackOffFactory.NewBackOffReturns(new(retryhttpfakes.FakeBackOff))
+				fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+				retryRoundTripper = &retryhttp.RetryRoundTripper{
+					Logger:         lager.NewLogger("test"),
+					BackOffFactory: fakeBackOffFactory,
+					RoundTripper:   fakeRoundTripper,
+					Endpoints:      endpoints,
+				}
+
+				var err error
+				request, err = http.NewRequest("GET", "http://atc/api/v1/info", nil)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("fails over from an endpoint whose certificate expired", func() {
+				fakeRoundTripper.RoundTripReturnsOnCall(0, nil, x509.CertificateInvalidError{Reason: x509.Expired})
+
+				_, err := retryRoundTripper.RoundTrip(request)
+				Expect(err).To(HaveOccurred())
+				Expect(hosts(1)).To(Equal([]string{"web-2"}))
+			})
+
+			It("fails over from an endpoint answering with server errors", func() {
+				fakeRoundTripper.RoundTripReturnsOnCall(0, &http.Response{StatusCode: http.StatusInternalServerError}, nil)
+
+				response, err := retryRoundTripper.RoundTrip(request)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response.StatusCode).To(Equal(http.StatusInternalServerError))
+				Expect(hosts(1)).To(Equal([]string{"web-2"}))
+			})
+		})
+
+		Context("when the failure is older than the TTL", func() {
+			BeforeEach(func() {
+				endpoints.FailureTTL = 10 * time.Millisecond
+			})
+
+			It("uses the endpoint again", func() {
+				endpoints.Report(urls[0], disaster)
+				Expect(hosts(1)).To(Equal([]string{"web-2"}))
+
+				time.Sleep(20 * time.Millisecond)
+				Expect(hosts(1)).To(Equal([]string{"web-1"}))
+			})
+		})
+	})
+})
@@ -0,0 +1,335 @@
+package retryhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v5"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// ServerSentEvent is an event received from a text/event-stream response.
+// ID is the last event ID seen on the stream when the event was dispatched.
+type ServerSentEvent struct {
+	ID   string
+	Type string
+	Data string
+}
+
+// EventSource subscribes to Server-Sent Events streams. Connection attempts
+// are retried by the RetryRoundTripper. When an established stream ends or
+// fails, the EventSource reconnects with the Last-Event-ID header after the
+// delay requested by the server's retry field, or otherwise the next interval
+// of a BackOff from the RetryRoundTripper's BackOffFactory. The BackOff is
+// reset whenever a stream delivers events, and reconnecting gives up once
+// streams failed to deliver any for longer than the BackOffFactory's max
+// elapsed time.
+type EventSource struct {
+	RetryRoundTripper *RetryRoundTripper
+}
+
+// EventStream delivers the events of a subscription. Events is closed when
+// the subscription ends, after which Err returns the reason.
+type EventStream struct {
+	Events <-chan ServerSentEvent
+
+	done chan struct{}
+	err  error
+}
+
+// Err returns the error that ended the subscription. It blocks until Events
+// is closed. It returns nil if the server ended the stream with 204 No
+// Content.
+func (s *EventStream) Err() error {
+	<-s.done
+	return s.err
+}
+
+// ErrNotEventStream is returned when the server responds with something other
+// than a text/event-stream.
+var ErrNotEventStream = errors.New("response is not an event stream")
+
+func (s *EventSource) Subscribe(ctx context.Context, request *http.Request) *EventStream {
+	events := make(chan ServerSentEvent)
+	stream := &EventStream{
+		Events: events,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(stream.done)
+		defer close(events)
+		stream.err = s.run(ctx, request, events)
+	}()
+
+	return stream
+}
+
+func (s *EventSource) run(ctx context.Context, request *http.Request, events chan<- ServerSentEvent) error {
+	logger := s.RetryRoundTripper.Logger.Session("event-source")
+
+	parser := &eventStreamParser{
+		lastEventID: request.Header.Get("Last-Event-ID"),
+	}
+
+	backOff := &decisionBackOff{BackOff: s.RetryRoundTripper.BackOffFactory.NewBackOff()}
+
+	// an outage starts with the stream that ended and lasts until a
+	// reconnected stream delivers events, each outage starting with a fresh
+	// backoff bounded by the max elapsed time
+	var ended error
+
+	for {
+		_, err := backoff.Retry(ctx, func() (struct{}, error) {
+			err := ended
+			ended = nil
+
+			if err == nil {
+				var delivered bool
+				delivered, err = s.stream(ctx, request, parser, events)
+				if delivered && !endsSubscription(ctx, err) {
+					ended = err
+					return struct{}{}, nil
+				}
+			}
+
+			if endsSubscription(ctx, err) {
+				return struct{}{}, backoff.Permanent(err)
+			}
+
+			if parser.retry > 0 {
+				backOff.apply(RetryDecision{Retry: true, Delay: parser.retry}, 0)
+			}
+
+			return struct{}{}, err
+		},
+			backoff.WithBackOff(backOff),
+			backoff.WithNotify(func(err error, next time.Duration) {
+				logger.Info("reconnecting", lager.Data{
+					"last-event-id": parser.lastEventID,
+					"error":         err.Error(),
+					"after":         next.String(),
+				})
+			}),
+			s.RetryRoundTripper.BackOffFactory.WithMaxElapsedTime(),
+		)
+
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, errNoContent):
+			return nil
+		}
+
+		var terminal *terminalStreamError
+		if errors.As(err, &terminal) {
+			return terminal.err
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// endsSubscription reports whether err, which ended a stream, ends the
+// subscription instead of reconnecting.
+func endsSubscription(ctx context.Context, err error) bool {
+	var terminal *terminalStreamError
+	return ctx.Err() != nil || errors.Is(err, errNoContent) || errors.As(err, &terminal)
+}
+
+// terminalStreamError ends a subscription instead of reconnecting.
+type terminalStreamError struct {
+	err error
+}
+
+func (e *terminalStreamError) Error() string {
+	return e.err.Error()
+}
+
+var (
+	errStreamEnded = errors.New("event stream ended")
+	errNoContent   = errors.New("event stream closed with 204 No Content")
+)
+
+// stream connects and dispatches events until the stream ends. It reports
+// whether any event was delivered.
+func (s *EventSource) stream(ctx context.Context, request *http.Request, parser *eventStreamParser, events chan<- ServerSentEvent) (bool, error) {
+	streamRequest := request.Clone(ctx)
+	streamRequest.Header.Set("Accept", "text/event-stream")
+	streamRequest.Header.Set("Cache-Control", "no-cache")
+	if parser.lastEventID != "" {
+		streamRequest.Header.Set("Last-Event-ID", parser.lastEventID)
+	}
+
+	response, err := s.RetryRoundTripper.RoundTrip(streamRequest)
+	if err != nil {
+		// the RetryRoundTripper already gave up on connecting
+		return false, &terminalStreamError{err}
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNoContent:
+		return false, errNoContent
+	case response.StatusCode != http.StatusOK:
+		return false, &terminalStreamError{fmt.Errorf("%w: status %d", ErrNotEventStream, response.StatusCode)}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if mediaType != "text/event-stream" {
+		return false, &terminalStreamError{fmt.Errorf("%w: content type %q", ErrNotEventStream, mediaType)}
+	}
+
+	var delivered bool
+
+	parser.newStream()
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(nil, 1<<20)
+	scanner.Split(scanEventStreamLines)
+
+	for scanner.Scan() {
+		event, ok := parser.parseLine(scanner.Text())
+		if !ok {
+			continue
+		}
+
+		select {
+		case events <- event:
+			delivered = true
+		case <-ctx.Done():
+			return delivered, ctx.Err()
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return delivered, err
+	}
+
+	return delivered, errStreamEnded
+}
+
+// eventStreamParser interprets the lines of a text/event-stream as described
+// by the HTML Living Standard. The last event ID and reconnection time carry
+// over across reconnects.
+type eventStreamParser struct {
+	lastEventID string
+	retry       time.Duration
+
+	// idBuffer holds the id of the event being parsed, which becomes the
+	// last event ID once the event is dispatched.
+	idBuffer  string
+	eventType string
+	data      strings.Builder
+	started   bool
+}
+
+// newStream discards any event left incomplete by the previous stream,
+// including its id.
+func (p *eventStreamParser) newStream() {
+	p.idBuffer = p.lastEventID
+	p.eventType = ""
+	p.data.Reset()
+	p.started = false
+}
+
+func (p *eventStreamParser) parseLine(line string) (ServerSentEvent, bool) {
+	if !p.started {
+		line = strings.TrimPrefix(line, "\ufeff")
+		p.started = true
+	}
+
+	if line == "" {
+		return p.dispatch()
+	}
+
+	if strings.HasPrefix(line, ":") {
+		return ServerSentEvent{}, false
+	}
+
+	field, value, _ := strings.Cut(line, ":")
+	value = strings.TrimPrefix(value, " ")
+
+	switch field {
+	case "event":
+		p.eventType = value
+	case "data":
+		p.data.WriteString(value)
+		p.data.WriteByte('\n')
+	case "id":
+		if !strings.ContainsRune(value, 0) {
+			p.idBuffer = value
+		}
+	case "retry":
+		if milliseconds, err := strconv.ParseUint(value, 10, 63); err == nil {
+			p.retry = time.Duration(milliseconds) * time.Millisecond
+		}
+	}
+
+	return ServerSentEvent{}, false
+}
+
+func (p *eventStreamParser) dispatch() (ServerSentEvent, bool) {
+	data := p.data.String()
+	eventType := p.eventType
+
+	p.data.Reset()
+	p.eventType = ""
+	p.lastEventID = p.idBuffer
+
+	if data == "" {
+		return ServerSentEvent{}, false
+	}
+
+	if eventType == "" {
+		eventType = "message"
+	}
+
+	return ServerSentEvent{
+		ID:   p.lastEventID,
+		Type: eventType,
+		Data: strings.TrimSuffix(data, "\n"),
+	}, true
+}
+
+// scanEventStreamLines splits lines ending in CRLF, LF or CR.
+func scanEventStreamLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+
+		// a CR at the end of the buffer may be followed by a LF
+		if i+1 == len(data) && !atEOF {
+			return 0, nil, nil
+		}
+
+		if i+1 < len(data) && data[i+1] == '\n' {
+			return i + 2, data[:i], nil
+		}
+
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF {
+		// an incomplete line at the end of the stream is discarded
+		return len(data), nil, nil
+	}
+
+	return 0, nil, nil
+}
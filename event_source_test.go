@@ -0,0 +1,225 @@
+package retryhttp_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/cenkalti/backoff/v5"
+	"github.com/concourse/retryhttp"
+	"github.com/concourse/retryhttp/retryhttpfakes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EventSource", func() {
+	var (
+		responses    []func(w http.ResponseWriter)
+		lastEventIDs []string
+		lock         sync.Mutex
+		server       *httptest.Server
+		transport    *http.Transport
+		fakeBackOff  *retryhttpfakes.FakeBackOff
+		eventSource  *retryhttp.EventSource
+		ctx          context.Context
+		cancel       context.CancelFunc
+		stream       *retryhttp.EventStream
+	)
+
+	eventStream := func(body string) func(w http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, body)
+		}
+	}
+
+	BeforeEach(func() {
+		responses = nil
+		lastEventIDs = nil
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+			respond := func(w http.ResponseWriter) { w.WriteHeader(http.StatusNoContent) }
+			if len(responses) > 0 {
+				respond = responses[0]
+				responses = responses[1:]
+			}
+			lock.Unlock()
+
+			Expect(r.Header.Get("Accept")).To(Equal("text/event-stream"))
+			respond(w)
+		}))
+
+		transport = &http.Transport{}
+		fakeBackOff = new(retryhttpfakes.FakeBackOff)
+		fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+		fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+		fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+		eventSource = &retryhttp.EventSource{
+			RetryRoundTripper: &retryhttp.RetryRoundTripper{
+				Logger:         lager.NewLogger("test"),
+				BackOffFactory: fakeBackOffFactory,
+				RoundTripper:   transport,
+			},
+		}
+
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+
+	AfterEach(func() {
+		cancel()
+		transport.CloseIdleConnections()
+		server.Close()
+	})
+
+	JustBeforeEach(func() {
+		request, err := http.NewRequest("GET", server.URL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		stream = eventSource.Subscribe(ctx, request)
+	})
+
+	receiveAll := func() []retryhttp.ServerSentEvent {
+		var events []retryhttp.ServerSentEvent
+		for event := range stream.Events {
+			events = append(events, event)
+		}
+		return events
+	}
+
+	Context("when the server sends events", func() {
+		BeforeEach(func() {
+			responses = append(responses, eventStream(
+				": a comment\n"+
+					"data: hello\n\n"+
+					"id: 1\r\nevent: greeting\r\ndata: multi\r\ndata:line\r\n\r\n"+
+					"id: 2\rdata: bye\r\r",
+			))
+		})
+
+		It("parses them", func() {
+			Expect(receiveAll()).To(Equal([]retryhttp.ServerSentEvent{
+				{ID: "", Type: "message", Data: "hello"},
+				{ID: "1", Type: "greeting", Data: "multi\nline"},
+				{ID: "2", Type: "message", Data: "bye"},
+			}))
+		})
+
+		It("reconnects with the last event ID when the stream ends", func() {
+			receiveAll()
+			Expect(stream.Err()).NotTo(HaveOccurred())
+			Expect(lastEventIDs).To(Equal([]string{"", "2"}))
+		})
+	})
+
+	Context("when the stream ends with an incomplete event", func() {
+		BeforeEach(func() {
+			responses = append(responses,
+				eventStream("id: 1\ndata: complete\n\nid: 2\ndata: incomplete\n"),
+				eventStream("id: 2\ndata: again\n\n"),
+			)
+		})
+
+		It("discards it", func() {
+			Expect(receiveAll()).To(Equal([]retryhttp.ServerSentEvent{
+				{ID: "1", Type: "message", Data: "complete"},
+				{ID: "2", Type: "message", Data: "again"},
+			}))
+			Expect(lastEventIDs).To(Equal([]string{"", "1", "2"}))
+		})
+	})
+
+	Context("when an event sets an id without data", func() {
+		BeforeEach(func() {
+			responses = append(responses, eventStream("id: 1\ndata: first\n\nid: 2\n\n"))
+		})
+
+		It("still reconnects with it", func() {
+			Expect(receiveAll()).To(Equal([]retryhttp.ServerSentEvent{
+				{ID: "1", Type: "message", Data: "first"},
+			}))
+			Expect(lastEventIDs).To(Equal([]string{"", "2"}))
+		})
+	})
+
+	Context("when the server sets the reconnection time", func() {
+		BeforeEach(func() {
+			fakeBackOff.NextBackOffReturns(time.Hour)
+			responses = append(responses,
+				eventStream("retry: 10\nid: 1\ndata: first\n\n"),
+				eventStream("id: 2\ndata: second\n\n"),
+			)
+		})
+
+		It("waits for that long instead of the backoff interval", func() {
+			Eventually(stream.Events).Should(Receive(Equal(retryhttp.ServerSentEvent{ID: "1", Type: "message", Data: "first"})))
+			Eventually(stream.Events).Should(Receive(Equal(retryhttp.ServerSentEvent{ID: "2", Type: "message", Data: "second"})))
+		})
+	})
+
+	Context("when the backoff policy ends", func() {
+		BeforeEach(func() {
+			fakeBackOff.NextBackOffReturns(backoff.Stop)
+			responses = append(responses, eventStream("data: only\n\n"))
+		})
+
+		It("ends the subscription", func() {
+			Expect(receiveAll()).To(HaveLen(1))
+			Expect(stream.Err()).To(HaveOccurred())
+			Expect(lastEventIDs).To(HaveLen(1))
+		})
+	})
+
+	Context("when reconnected streams keep failing to deliver events", func() {
+		BeforeEach(func() {
+			eventSource.RetryRoundTripper.BackOffFactory = retryhttp.NewExponentialBackOffFactory(2 * time.Second)
+			responses = append(responses, eventStream("data: only\n\n"))
+			for range 10 {
+				responses = append(responses, eventStream(": nothing\n\n"))
+			}
+		})
+
+		It("ends the subscription once the backoff policy's max elapsed time has passed", func() {
+			Eventually(stream.Events).Should(Receive())
+			Eventually(stream.Events, 10*time.Second).Should(BeClosed())
+			Expect(stream.Err()).To(MatchError("event stream ended"))
+
+			lock.Lock()
+			defer lock.Unlock()
+			Expect(len(lastEventIDs)).To(BeNumerically("<=", 5))
+		})
+	})
+
+	Context("when the response is not an event stream", func() {
+		BeforeEach(func() {
+			responses = append(responses, func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "text/html")
+				io.WriteString(w, "<html></html>")
+			})
+		})
+
+		It("ends the subscription with an error", func() {
+			Expect(receiveAll()).To(BeEmpty())
+			Expect(stream.Err()).To(MatchError(retryhttp.ErrNotEventStream))
+		})
+	})
+
+	Context("when the context is canceled", func() {
+		BeforeEach(func() {
+			fakeBackOff.NextBackOffReturns(5 * time.Second)
+			responses = append(responses, eventStream("data: first\n\n"))
+		})
+
+		It("ends the subscription", func() {
+			Eventually(stream.Events).Should(Receive())
+			cancel()
+			Eventually(stream.Events).Should(BeClosed())
+			Expect(stream.Err()).To(MatchError(context.Canceled))
+		})
+	})
+})
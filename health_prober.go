@@ -0,0 +1,178 @@
+package retryhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// ErrHostDown is returned, wrapped, for attempts that were not sent because
+// the HealthProber considers their host down.
+var ErrHostDown = errors.New("host is down")
+
+// HealthProber actively probes the hosts it is asked about and tracks whether
+// they are up. Probing a host starts the first time Up is called for it and
+// continues every Interval until Stop is called. A stopped HealthProber
+// forgets what it knew and considers every host up without probing it.
+type HealthProber struct {
+	Logger lager.Logger
+
+	// RoundTripper sends the probes, defaulting to http.DefaultTransport.
+	RoundTripper RoundTripper
+
+	// Path is requested with GET on every host, defaulting to "/". Hosts
+	// are up if they answer with ExpectedStatus, defaulting to 200, within
+	// Timeout.
+	Path           string
+	ExpectedStatus int
+	Interval       time.Duration
+	Timeout        time.Duration
+
+	lock    sync.Mutex
+	hosts   map[string]*probedHost
+	done    chan struct{}
+	stopped bool
+}
+
+type probedHost struct {
+	url  *url.URL
+	down bool
+}
+
+// Up reports whether the host of the URL is up. Hosts are up until a probe
+// fails. Unix sockets addressed by http+unix URLs cannot be probed and are
+// always up.
+func (p *HealthProber) Up(u *url.URL) bool {
+	if u == nil || u.Host == "" || u.Scheme == UnixSocketScheme {
+		return true
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopped {
+		return true
+	}
+
+	key := endpointKey(u)
+	host, found := p.hosts[key]
+	if !found {
+		if p.hosts == nil {
+			p.hosts = map[string]*probedHost{}
+		}
+		if p.done == nil {
+			p.done = make(chan struct{})
+		}
+
+		host = &probedHost{url: &url.URL{Scheme: u.Scheme, Host: u.Host}}
+		p.hosts[key] = host
+
+		go p.probeEvery(host, p.done)
+	}
+
+	return !host.down
+}
+
+// Stop stops probing all hosts. From then on, Up reports every host up.
+func (p *HealthProber) Stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+
+	p.hosts = nil
+	p.stopped = true
+}
+
+func (p *HealthProber) probeEvery(host *probedHost, done <-chan struct{}) {
+	interval := p.Interval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.probe(host)
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *HealthProber) probe(host *probedHost) {
+	err := p.check(host.url)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	down := err != nil
+	if down == host.down {
+		return
+	}
+	host.down = down
+
+	if down {
+		p.Logger.Info("host-down", lager.Data{"host": host.url.Host, "error": err.Error()})
+	} else {
+		p.Logger.Info("host-up", lager.Data{"host": host.url.Host})
+	}
+}
+
+func (p *HealthProber) check(u *url.URL) error {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	path := p.Path
+	if path == "" {
+		path = "/"
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u.JoinPath(path).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	var roundTripper RoundTripper = http.DefaultTransport
+	if p.RoundTripper != nil {
+		roundTripper = p.RoundTripper
+	}
+
+	response, err := roundTripper.RoundTrip(request)
+	if err != nil {
+		return err
+	}
+
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	expectedStatus := p.ExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+
+	if response.StatusCode != expectedStatus {
+		return fmt.Errorf("probe returned status %d", response.StatusCode)
+	}
+
+	return nil
+}
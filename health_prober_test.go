@@ -0,0 +1,294 @@
+package retryhttp_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	"github.com/cenkalti/backoff/v5"
+	"github.com/concourse/retryhttp"
+	"github.com/concourse/retryhttp/retryhttpfakes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("HealthProber", func() {
+	var (
+		healthy     atomic.Bool
+		probedPaths chan string
+		server      *httptest.Server
+		serverURL   *url.URL
+		logger      *lagertest.TestLogger
+		prober      *retryhttp.HealthProber
+	)
+
+	BeforeEach(func() {
+		healthy.Store(true)
+		probedPaths = make(chan string, 100)
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case probedPaths <- r.URL.Path:
+			default:
+			}
+
+			if healthy.Load() {
+				w.WriteHeader(http.StatusNoContent)
+			} else {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+
+		var err error
+		serverURL, err = url.Parse(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("test")
+		prober = &retryhttp.HealthProber{
+			Logger:         logger,
+			Path:           "/healthz",
+			ExpectedStatus: http.StatusNoContent,
+			Interval:       10 * time.Millisecond,
+		}
+	})
+
+	AfterEach(func() {
+		prober.Stop()
+		server.Close()
+	})
+
+	up := func(u *url.URL) func() bool {
+		return func() bool { return prober.Up(u) }
+	}
+
+	It("probes hosts once they are asked about", func() {
+		Expect(prober.Up(serverURL.JoinPath("some", "path"))).To(BeTrue())
+		Eventually(probedPaths).Should(Receive(Equal("/healthz")))
+	})
+
+	It("marks hosts down and up again as their probes fail and succeed", func() {
+		Expect(prober.Up(serverURL)).To(BeTrue())
+
+		healthy.Store(false)
+		Eventually(up(serverURL)).Should(BeFalse())
+		Expect(logger).To(gbytes.Say("host-down"))
+
+		healthy.Store(true)
+		Eventually(up(serverURL)).Should(BeTrue())
+		Expect(logger).To(gbytes.Say("host-up"))
+	})
+
+	It("marks hosts that do not answer down", func() {
+		server.Close()
+		Eventually(up(serverURL)).Should(BeFalse())
+	})
+
+	It("stops probing when stopped", func() {
+		prober.Up(serverURL)
+		Eventually(probedPaths).Should(Receive())
+
+		prober.Stop()
+		time.Sleep(20 * time.Millisecond)
+		for len(probedPaths) > 0 {
+			<-probedPaths
+		}
+		Consistently(probedPaths, 50*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("considers every host up once stopped", func() {
+		healthy.Store(false)
+		Eventually(up(serverURL)).Should(BeFalse())
+
+		prober.Stop()
+		Expect(prober.Up(serverURL)).To(BeTrue())
+
+		otherURL := &url.URL{Scheme: "http", Host: "localhost:1"}
+		Expect(prober.Up(otherURL)).To(BeTrue())
+
+		time.Sleep(20 * time.Millisecond)
+		for len(probedPaths) > 0 {
+			<-probedPaths
+		}
+		Consistently(probedPaths, 50*time.Millisecond).ShouldNot(Receive())
+		Expect(prober.Up(otherURL)).To(BeTrue())
+	})
+
+	It("does not probe unix sockets", func() {
+		fakeRoundTripper := new(retryhttpfakes.FakeRoundTripper)
+		fakeRoundTripper.RoundTripReturns(nil, errors.New("invalid URL escape"))
+		prober.RoundTripper = fakeRoundTripper
+
+		socketURL := retryhttp.UnixSocketURL(filepath.Join(GinkgoT().TempDir(), "garden.sock"), "/containers")
+		Consistently(up(socketURL), 50*time.Millisecond).Should(BeTrue())
+		Expect(fakeRoundTripper.RoundTripCallCount()).To(BeZero())
+	})
+
+	Context("when used by a RetryRoundTripper", func() {
+		var (
+			fakeRoundTripper  *retryhttpfakes.FakeRoundTripper
+			fakeBackOff       *retryhttpfakes.FakeBackOff
+			retryRoundTripper *retryhttp.RetryRoundTripper
+			downURL           *url.URL
+		)
+
+		BeforeEach(func() {
+			fakeRoundTripper = new(retryhttpfakes.FakeRoundTripper)
+			fakeRoundTripper.RoundTripReturns(&http.Response{StatusCode: http.StatusOK}, nil)
+			fakeBackOff = new(retryhttpfakes.FakeBackOff)
+			fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+			fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+			fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+			retryRoundTripper = &retryhttp.RetryRoundTripper{
+				Logger:         logger,
+				BackOffFactory: fakeBackOffFactory,
+				RoundTripper:   fakeRoundTripper,
+				HealthProber:   prober,
+			}
+
+			healthy.Store(false)
+			downURL = serverURL.JoinPath("api")
+			Eventually(up(downURL)).Should(BeFalse())
+		})
+
+		It("does not send requests to hosts that are down", func() {
+			fakeBackOff.NextBackOffReturnsOnCall(1, backoff.Stop)
+
+			request, err := http.NewRequest("GET", downURL.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = retryRoundTripper.RoundTrip(request)
+			Expect(err).To(MatchError(retryhttp.ErrHostDown))
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(BeZero())
+			Expect(fakeBackOff.NextBackOffCallCount()).To(Equal(2))
+		})
+
+		It("skips to endpoints that are up", func() {
+			fakeEndpoints := new(retryhttpfakes.FakeEndpoints)
+			fakeEndpoints.NextReturnsOnCall(0, serverURL)
+			fakeEndpoints.NextReturnsOnCall(1, &url.URL{Scheme: "http", Host: "web-2"})
+			retryRoundTripper.Endpoints = fakeEndpoints
+
+			request, err := http.NewRequest("GET", downURL.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = retryRoundTripper.RoundTrip(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+			Expect(fakeRoundTripper.RoundTripArgsForCall(0).URL.Host).To(Equal("web-2"))
+
+			_, reported := fakeEndpoints.ReportArgsForCall(0)
+			Expect(reported).To(MatchError(retryhttp.ErrHostDown))
+		})
+	})
+
+	Context("when used by a RetryHijackableClient", func() {
+		It("does not send requests to hosts that are down", func() {
+			fakeHijackableClient := new(retryhttpfakes.FakeHijackableClient)
+			fakeBackOff := new(retryhttpfakes.FakeBackOff)
+			fakeBackOff.NextBackOffReturnsOnCall(1, backoff.Stop)
+			fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+			fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+			fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+			retryHijackableClient := &retryhttp.RetryHijackableClient{
+				Logger:           logger,
+				BackOffFactory:   fakeBackOffFactory,
+				HijackableClient: fakeHijackableClient,
+				HealthProber:     prober,
+			}
+
+			healthy.Store(false)
+			Eventually(up(serverURL)).Should(BeFalse())
+
+			request, err := http.NewRequest("GET", serverURL.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = retryHijackableClient.Do(request)
+			Expect(err).To(MatchError(retryhttp.ErrHostDown))
+			Expect(fakeHijackableClient.DoCallCount()).To(BeZero())
+		})
+
+		It("sends requests that do not go directly to their host regardless of it", func() {
+			fakeHijackableClient := new(retryhttpfakes.FakeHijackableClient)
+			fakeHijackableClient.DoReturns(&http.Response{StatusCode: http.StatusTeapot}, nil, nil)
+			fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+			fakeBackOffFactory.NewBackOffReturns(new(retryhttpfakes.FakeBackOff))
+			fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+			retryHijackableClient := &retryhttp.RetryHijackableClient{
+				Logger:           logger,
+				BackOffFactory:   fakeBackOffFactory,
+				HijackableClient: indirectHijackableClient{fakeHijackableClient},
+				HealthProber:     prober,
+			}
+
+			healthy.Store(false)
+			Eventually(up(serverURL)).Should(BeFalse())
+
+			request, err := http.NewRequest("GET", serverURL.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			response, _, err := retryHijackableClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusTeapot))
+			Expect(fakeHijackableClient.DoCallCount()).To(Equal(1))
+		})
+
+		It("sends requests through a socket path regardless of the request's host", func() {
+			socketPath := filepath.Join(GinkgoT().TempDir(), "garden.sock")
+			listener, err := net.Listen("unix", socketPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			socketServer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			})}
+			go socketServer.Serve(listener)
+			defer socketServer.Close()
+
+			fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+			fakeBackOffFactory.NewBackOffReturns(new(retryhttpfakes.FakeBackOff))
+			fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+			retryHijackableClient := &retryhttp.RetryHijackableClient{
+				Logger:         logger,
+				BackOffFactory: fakeBackOffFactory,
+				HijackableClient: &retryhttp.BasicHijackableClient{
+					DialContext:           (&net.Dialer{}).DialContext,
+					SocketPath:            socketPath,
+					DoHijackCloserFactory: retryhttp.DefaultDoHijackCloserFactory,
+				},
+				HealthProber: prober,
+			}
+
+			// the prober considers the request's host down
+			healthy.Store(false)
+			gardenURL := &url.URL{Scheme: "http", Host: serverURL.Host, Path: "/containers"}
+			Eventually(up(gardenURL)).Should(BeFalse())
+
+			request, err := http.NewRequest("GET", gardenURL.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			response, hijackCloser, err := retryHijackableClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer hijackCloser.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusTeapot))
+		})
+	})
+})
+
+// indirectHijackableClient sends every request somewhere other than its host.
+type indirectHijackableClient struct {
+	*retryhttpfakes.FakeHijackableClient
+}
+
+func (indirectHijackableClient) Direct(*http.Request) bool {
+	return false
+}
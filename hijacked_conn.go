@@ -0,0 +1,90 @@
+package retryhttp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// ErrHalfCloseUnsupported is returned when closing one direction of a
+// connection that cannot be half-closed.
+var ErrHalfCloseUnsupported = errors.New("connection does not support half-close")
+
+// HalfCloser is implemented by the connections returned by HijackedConn.
+// CloseWrite signals EOF to the server while its responses keep flowing, and
+// CloseRead stops reading from it. Both work over the TCP, TLS and unix
+// socket connections dialed by BasicHijackableClient, and fail with
+// ErrHalfCloseUnsupported over any other.
+type HalfCloser interface {
+	CloseWrite() error
+	CloseRead() error
+}
+
+// HijackedConn merges the connection and reader returned by
+// HijackCloser.Hijack into a single net.Conn whose reads first drain the bytes
+// the reader already buffered. Writes, deadlines and Close go to the
+// connection, so it can be handed to io.Copy and other net.Conn consumers. It
+// also implements HalfCloser:
+//
+//	conn := retryhttp.HijackedConn(hijackCloser.Hijack())
+//	conn.(retryhttp.HalfCloser).CloseWrite()
+func HijackedConn(c net.Conn, r *bufio.Reader) net.Conn {
+	return &hijackedConn{Conn: c, reader: r}
+}
+
+type hijackedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads through the reader, if any, which reads straight from the
+// connection once its buffer is empty.
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	if c.reader == nil {
+		return c.Conn.Read(p)
+	}
+
+	return c.reader.Read(p)
+}
+
+func (c *hijackedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *hijackedConn) CloseRead() error {
+	return closeRead(c.Conn)
+}
+
+// closeWrite shuts down the writing side of the connection. Over TLS, it
+// sends a close_notify alert before shutting down the underlying connection's
+// writing side.
+func closeWrite(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.CloseWrite(); err != nil {
+			return err
+		}
+
+		conn = tlsConn.NetConn()
+	}
+
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+
+	return ErrHalfCloseUnsupported
+}
+
+// closeRead shuts down the reading side of the connection, or of the
+// connection underlying TLS.
+func closeRead(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	if closer, ok := conn.(interface{ CloseRead() error }); ok {
+		return closer.CloseRead()
+	}
+
+	return ErrHalfCloseUnsupported
+}
@@ -0,0 +1,236 @@
+package retryhttp_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/concourse/retryhttp"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HijackedConn", func() {
+	var (
+		clientConn net.Conn
+		serverConn net.Conn
+		conn       net.Conn
+	)
+
+	BeforeEach(func() {
+		clientConn, serverConn = net.Pipe()
+
+		serverConn := serverConn
+		go func() {
+			reader := bufio.NewReader(serverConn)
+			if _, err := http.ReadRequest(reader); err != nil {
+				return
+			}
+
+			io.WriteString(serverConn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: tcp\r\nConnection: Upgrade\r\n\r\nread ahead")
+			io.WriteString(serverConn, ", then streamed")
+
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(serverConn, " and echoed: "+line)
+			serverConn.Close()
+		}()
+
+		doHijackCloser := retryhttp.DefaultDoHijackCloserFactory.NewDoHijackCloser(clientConn, nil)
+
+		request, err := http.NewRequest("GET", "http://garden/stream", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		response, err := doHijackCloser.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+
+		conn = retryhttp.HijackedConn(doHijackCloser.Hijack())
+	})
+
+	AfterEach(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	It("reads the buffered bytes before the connection's", func() {
+		buf := make([]byte, len("read ahead, then streamed"))
+		_, err := io.ReadFull(conn, buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(buf)).To(Equal("read ahead, then streamed"))
+
+		_, err = io.WriteString(conn, "hello\n")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(io.ReadAll(conn)).To(Equal([]byte(" and echoed: hello\n")))
+	})
+
+	It("delegates deadlines to the connection", func() {
+		Expect(conn.SetReadDeadline(time.Now().Add(-time.Second))).To(Succeed())
+
+		data, err := io.ReadAll(conn)
+		Expect(string(data)).To(Equal("read ahead"))
+		Expect(err).To(MatchError(os.ErrDeadlineExceeded))
+	})
+
+	It("closes the connection", func() {
+		Expect(conn.Close()).To(Succeed())
+
+		_, err := clientConn.Write([]byte("x"))
+		Expect(err).To(MatchError(io.ErrClosedPipe))
+	})
+
+	It("fails to half-close connections that do not support it", func() {
+		closer, ok := conn.(retryhttp.HalfCloser)
+		Expect(ok).To(BeTrue())
+		Expect(closer.CloseWrite()).To(MatchError(retryhttp.ErrHalfCloseUnsupported))
+		Expect(closer.CloseRead()).To(MatchError(retryhttp.ErrHalfCloseUnsupported))
+	})
+
+	Context("without a reader", func() {
+		It("reads from the connection", func() {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go io.WriteString(server, "direct")
+
+			buf := make([]byte, len("direct"))
+			_, err := io.ReadFull(retryhttp.HijackedConn(client, nil), buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf)).To(Equal("direct"))
+		})
+	})
+})
+
+var _ = Describe("HijackedConn half-close", func() {
+	var (
+		hijackableClient *retryhttp.BasicHijackableClient
+		request          *http.Request
+		conn             net.Conn
+	)
+
+	// echo upgrades the connection and echoes what it reads until EOF, then
+	// says goodbye
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hijacked, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer hijacked.Close()
+
+		io.WriteString(hijacked, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(hijacked, buffered.Reader)
+		io.WriteString(hijacked, "bye")
+	})
+
+	BeforeEach(func() {
+		hijackableClient = &retryhttp.BasicHijackableClient{
+			DialContext:           (&net.Dialer{}).DialContext,
+			DoHijackCloserFactory: retryhttp.DefaultDoHijackCloserFactory,
+		}
+	})
+
+	JustBeforeEach(func() {
+		response, hijackCloser, err := hijackableClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+
+		conn = retryhttp.HijackedConn(hijackCloser.Hijack())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+	})
+
+	itHalfCloses := func() {
+		It("keeps reading after closing the writing side", func() {
+			_, err := io.WriteString(conn, "stdin")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(conn.(retryhttp.HalfCloser).CloseWrite()).To(Succeed())
+			Expect(io.ReadAll(conn)).To(Equal([]byte("stdinbye")))
+		})
+
+		It("stops reading after closing the reading side", func() {
+			Expect(conn.(retryhttp.HalfCloser).CloseRead()).To(Succeed())
+
+			_, err := conn.Read(make([]byte, 1))
+			Expect(err).To(HaveOccurred())
+		})
+	}
+
+	Context("over TCP", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(echo)
+
+			var err error
+			request, err = http.NewRequest("GET", server.URL, nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		itHalfCloses()
+	})
+
+	Context("over TLS", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewTLSServer(echo)
+
+			roots := x509.NewCertPool()
+			roots.AddCert(server.Certificate())
+			hijackableClient.TLSConfig = &tls.Config{RootCAs: roots}
+
+			var err error
+			request, err = http.NewRequest("GET", server.URL, nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		itHalfCloses()
+	})
+
+	Context("over a unix socket", func() {
+		var server *http.Server
+
+		BeforeEach(func() {
+			socketPath := filepath.Join(GinkgoT().TempDir(), "garden.sock")
+			listener, err := net.Listen("unix", socketPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			server = &http.Server{Handler: echo}
+			go server.Serve(listener)
+
+			request = &http.Request{
+				Method: "GET",
+				URL:    retryhttp.UnixSocketURL(socketPath, "/"),
+				Header: http.Header{},
+			}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		itHalfCloses()
+	})
+})
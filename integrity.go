@@ -0,0 +1,182 @@
+package retryhttp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ChecksumFunc returns the hash to compute over a response body and the
+// digest it is expected to produce. Returning a nil hash skips the check.
+type ChecksumFunc func(response *http.Response) (hash.Hash, []byte)
+
+// IntegrityError is returned when a response body does not match its
+// Content-Length, its digest headers or the caller's checksum, or could not
+// be read in full. Err is the error that cut the body short, if any.
+type IntegrityError struct {
+	Check    string
+	Expected string
+	Actual   string
+	Err      error
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("response integrity check %s failed: expected %s, got %s: %s", e.Check, e.Expected, e.Actual, e.Err)
+	}
+
+	return fmt.Sprintf("response integrity check %s failed: expected %s, got %s", e.Check, e.Expected, e.Actual)
+}
+
+func (e *IntegrityError) Unwrap() error {
+	return e.Err
+}
+
+var digestAlgorithms = []struct {
+	name    string
+	newHash func() hash.Hash
+}{
+	{"sha-512", sha512.New},
+	{"sha-256", sha256.New},
+}
+
+// verifiesIntegrity reports whether the response to the request is checked.
+// Only idempotent requests are checked, since a mismatch is retried, and only
+// responses that carry a body.
+func verifiesIntegrity(request *http.Request, response *http.Response) bool {
+	if !idempotent(request.Method) || request.Method == http.MethodHead {
+		return false
+	}
+
+	return response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusNotModified
+}
+
+// idempotent reports whether sending a request with the method more than
+// once has the same effect as sending it once.
+func idempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+// verifyIntegrity reads the whole response body and checks it. On success
+// the response is returned with its body buffered in memory; otherwise the
+// body is discarded.
+func verifyIntegrity(response *http.Response, checksum ChecksumFunc) (*http.Response, error) {
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		expected := "a complete body"
+		if response.ContentLength >= 0 {
+			expected = strconv.FormatInt(response.ContentLength, 10)
+		}
+
+		return nil, &IntegrityError{
+			Check:    "content-length",
+			Expected: expected,
+			Actual:   strconv.Itoa(len(body)),
+			Err:      err,
+		}
+	}
+
+	if response.ContentLength >= 0 && int64(len(body)) != response.ContentLength {
+		return nil, &IntegrityError{
+			Check:    "content-length",
+			Expected: strconv.FormatInt(response.ContentLength, 10),
+			Actual:   strconv.Itoa(len(body)),
+		}
+	}
+
+	// digest headers describe the encoded content, which is gone once the
+	// transport decompressed it
+	if !response.Uncompressed {
+		for _, algorithm := range digestAlgorithms {
+			expected, found := expectedDigest(response.Header, algorithm.name)
+			if !found {
+				continue
+			}
+
+			if err := verifyDigest(algorithm.name, algorithm.newHash(), expected, body); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	if checksum != nil {
+		if h, expected := checksum(response); h != nil {
+			if err := verifyDigest("checksum", h, expected, body); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	response.Body = io.NopCloser(bytes.NewReader(body))
+
+	return response, nil
+}
+
+func verifyDigest(check string, h hash.Hash, expected []byte, body []byte) error {
+	h.Write(body)
+
+	actual := h.Sum(nil)
+	if !bytes.Equal(actual, expected) {
+		return &IntegrityError{
+			Check:    check,
+			Expected: hex.EncodeToString(expected),
+			Actual:   hex.EncodeToString(actual),
+		}
+	}
+
+	return nil
+}
+
+// expectedDigest looks up the digest computed with the given algorithm in
+// the Content-Digest header (RFC 9530), falling back to the obsolete Digest
+// header (RFC 3230).
+func expectedDigest(header http.Header, algorithm string) ([]byte, bool) {
+	for _, value := range header.Values("Content-Digest") {
+		for _, member := range strings.Split(value, ",") {
+			key, encoded, found := strings.Cut(strings.TrimSpace(member), "=")
+			if !found || key != algorithm {
+				continue
+			}
+
+			encoded, isByteSequence := strings.CutPrefix(encoded, ":")
+			encoded, isByteSequenceEnd := strings.CutSuffix(encoded, ":")
+			if !isByteSequence || !isByteSequenceEnd {
+				continue
+			}
+
+			if digest, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+				return digest, true
+			}
+		}
+	}
+
+	for _, value := range header.Values("Digest") {
+		for _, member := range strings.Split(value, ",") {
+			key, encoded, found := strings.Cut(strings.TrimSpace(member), "=")
+			if !found || !strings.EqualFold(key, algorithm) {
+				continue
+			}
+
+			if digest, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+				return digest, true
+			}
+		}
+	}
+
+	return nil, false
+}
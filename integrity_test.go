@@ -0,0 +1,299 @@
+package retryhttp_test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/cenkalti/backoff/v5"
+	"github.com/concourse/retryhttp"
+	"github.com/concourse/retryhttp/retryhttpfakes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Integrity verification", func() {
+	var (
+		fakeRoundTripper  *retryhttpfakes.FakeRoundTripper
+		fakeBackOff       *retryhttpfakes.FakeBackOff
+		retryRoundTripper *retryhttp.RetryRoundTripper
+		request           *http.Request
+		response          *http.Response
+		roundTripErr      error
+	)
+
+	newResponse := func(body string, contentLength int64, header http.Header) *http.Response {
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        header,
+			ContentLength: contentLength,
+			Body:          io.NopCloser(strings.NewReader(body)),
+		}
+	}
+
+	sha256Of := func(body string) string {
+		sum := sha256.Sum256([]byte(body))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	BeforeEach(func() {
+		fakeRoundTripper = new(retryhttpfakes.FakeRoundTripper)
+		fakeBackOff = new(retryhttpfakes.FakeBackOff)
+		fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+		fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+		fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+		retryRoundTripper = &retryhttp.RetryRoundTripper{
+			Logger:          lager.NewLogger("test"),
+			BackOffFactory:  fakeBackOffFactory,
+			RoundTripper:    fakeRoundTripper,
+			VerifyIntegrity: true,
+		}
+
+		var err error
+		request, err = http.NewRequest("GET", "http://example.com/blob", nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		response, roundTripErr = retryRoundTripper.RoundTrip(request)
+	})
+
+	readBody := func() string {
+		body, err := io.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return string(body)
+	}
+
+	Context("when the body is shorter than its Content-Length", func() {
+		BeforeEach(func() {
+			fakeRoundTripper.RoundTripReturnsOnCall(0, newResponse("hello", 11, nil), nil)
+			fakeRoundTripper.RoundTripReturnsOnCall(1, newResponse("hello world", 11, nil), nil)
+		})
+
+		It("retries and returns the complete response", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+			Expect(readBody()).To(Equal("hello world"))
+		})
+	})
+
+	Context("when the body does not match its Content-Digest", func() {
+		BeforeEach(func() {
+			header := http.Header{"Content-Digest": {"sha-256=:" + sha256Of("hello world") + ":"}}
+			fakeRoundTripper.RoundTripReturnsOnCall(0, newResponse("hello there", -1, header), nil)
+			fakeRoundTripper.RoundTripReturnsOnCall(1, newResponse("hello world", -1, header), nil)
+		})
+
+		It("retries and returns the matching response", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+			Expect(readBody()).To(Equal("hello world"))
+		})
+	})
+
+	Context("when the body does not match its Digest", func() {
+		BeforeEach(func() {
+			header := http.Header{"Digest": {"SHA-256=" + sha256Of("hello world")}}
+			fakeRoundTripper.RoundTripReturnsOnCall(0, newResponse("hello there", -1, header), nil)
+			fakeRoundTripper.RoundTripReturnsOnCall(1, newResponse("hello world", -1, header), nil)
+		})
+
+		It("retries and returns the matching response", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+			Expect(readBody()).To(Equal("hello world"))
+		})
+	})
+
+	Context("when the response was decompressed by the transport", func() {
+		BeforeEach(func() {
+			header := http.Header{"Content-Digest": {"sha-256=:" + sha256Of("compressed") + ":"}}
+			decompressed := newResponse("hello world", -1, header)
+			decompressed.Uncompressed = true
+			fakeRoundTripper.RoundTripReturns(decompressed, nil)
+		})
+
+		It("does not check the digest", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when a checksum is provided", func() {
+		BeforeEach(func() {
+			sum := md5.Sum([]byte("hello world"))
+			retryRoundTripper.Checksum = func(*http.Response) (hash.Hash, []byte) {
+				return md5.New(), sum[:]
+			}
+
+			fakeRoundTripper.RoundTripReturnsOnCall(0, newResponse("hello there", -1, nil), nil)
+			fakeRoundTripper.RoundTripReturnsOnCall(1, newResponse("hello world", -1, nil), nil)
+		})
+
+		It("verifies the body against it", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+			Expect(readBody()).To(Equal("hello world"))
+		})
+	})
+
+	Context("when every attempt fails the check", func() {
+		BeforeEach(func() {
+			fakeRoundTripper.RoundTripStub = func(*http.Request) (*http.Response, error) {
+				return newResponse("hello", 11, nil), nil
+			}
+			fakeBackOff.NextBackOffStub = func() time.Duration {
+				if fakeBackOff.NextBackOffCallCount() >= 3 {
+					return backoff.Stop
+				}
+				return 0
+			}
+		})
+
+		It("returns an integrity error", func() {
+			Expect(response).To(BeNil())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(3))
+
+			var integrityErr *retryhttp.IntegrityError
+			Expect(roundTripErr).To(BeAssignableToTypeOf(integrityErr))
+			Expect(roundTripErr).To(MatchError(&retryhttp.IntegrityError{
+				Check:    "content-length",
+				Expected: "11",
+				Actual:   "5",
+			}))
+		})
+	})
+
+	Context("when the request is not idempotent", func() {
+		BeforeEach(func() {
+			request.Method = "POST"
+			fakeRoundTripper.RoundTripReturns(newResponse("hello", 11, nil), nil)
+		})
+
+		It("does not verify the response", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when verification is disabled", func() {
+		BeforeEach(func() {
+			retryRoundTripper.VerifyIntegrity = false
+			fakeRoundTripper.RoundTripReturns(newResponse("hello", 11, nil), nil)
+		})
+
+		It("does not verify the response", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+		})
+	})
+})
+
+var _ = Describe("Integrity verification through a transport", func() {
+	var (
+		truncatedResponses int32
+		requests           atomic.Int32
+		server             *httptest.Server
+		transport          *http.Transport
+		fakeBackOff        *retryhttpfakes.FakeBackOff
+		retryRoundTripper  *retryhttp.RetryRoundTripper
+		response           *http.Response
+		roundTripErr       error
+	)
+
+	BeforeEach(func() {
+		truncatedResponses = 1
+		requests.Store(0)
+
+		fakeBackOff = new(retryhttpfakes.FakeBackOff)
+		fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+		fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+		fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+		transport = &http.Transport{}
+		retryRoundTripper = &retryhttp.RetryRoundTripper{
+			Logger:          lager.NewLogger("test"),
+			BackOffFactory:  fakeBackOffFactory,
+			RoundTripper:    transport,
+			VerifyIntegrity: true,
+		}
+	})
+
+	AfterEach(func() {
+		transport.CloseIdleConnections()
+		server.Close()
+	})
+
+	JustBeforeEach(func() {
+		truncatedResponses := truncatedResponses
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "11")
+
+			if requests.Add(1) > truncatedResponses {
+				io.WriteString(w, "hello world")
+				return
+			}
+
+			// send part of the body and hang up
+			io.WriteString(w, "hello")
+			w.(http.Flusher).Flush()
+
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}))
+
+		request, err := http.NewRequest("GET", server.URL, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		response, roundTripErr = retryRoundTripper.RoundTrip(request)
+	})
+
+	Context("when the connection breaks before the end of the body", func() {
+		It("retries and returns the complete response", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(requests.Load()).To(Equal(int32(2)))
+
+			body, err := io.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("hello world"))
+		})
+	})
+
+	Context("when every attempt is cut short", func() {
+		BeforeEach(func() {
+			truncatedResponses = 3
+			fakeBackOff.NextBackOffStub = func() time.Duration {
+				if fakeBackOff.NextBackOffCallCount() >= 3 {
+					return backoff.Stop
+				}
+				return 0
+			}
+		})
+
+		It("returns an integrity error wrapping the read error", func() {
+			Expect(response).To(BeNil())
+			Expect(requests.Load()).To(Equal(int32(3)))
+
+			var integrityErr *retryhttp.IntegrityError
+			Expect(roundTripErr).To(BeAssignableToTypeOf(integrityErr))
+			Expect(roundTripErr).To(MatchError(io.ErrUnexpectedEOF))
+			Expect(roundTripErr.(*retryhttp.IntegrityError).Check).To(Equal("content-length"))
+		})
+	})
+})
@@ -0,0 +1,211 @@
+package retryhttp
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// BalancingStrategy determines how LoadBalancer picks among healthy hosts.
+type BalancingStrategy int
+
+const (
+	// LeastOutstanding picks the host with the fewest requests in flight.
+	LeastOutstanding BalancingStrategy = iota
+	// PowerOfTwoChoices picks two hosts at random and uses the one with
+	// fewer requests in flight.
+	PowerOfTwoChoices
+)
+
+// Defaults used by LoadBalancer for fields left zero.
+const (
+	DefaultMaxErrorRate     = 0.5
+	DefaultMinRequests      = 5
+	DefaultBaseEjectionTime = 30 * time.Second
+)
+
+// outcomeWindow is the number of recent outcomes a host's error rate is
+// computed over.
+const outcomeWindow = 20
+
+// LoadBalancer spreads requests across equivalent hosts and passively ejects
+// hosts whose error rate over their recent requests exceeds MaxErrorRate,
+// once at least MinRequests outcomes were seen. An ejected host is not used
+// for BaseEjectionTime times the number of times in a row it was ejected. If
+// every host is ejected, all of them are used.
+//
+// It is an Endpoints, to be set as RetryRoundTripper.Endpoints so that the
+// outcome of every attempt counts towards the hosts' health, and also a
+// RoundTripper sending requests through RoundTripper on its own, counting
+// errors and 5xx responses as failures. Either way, a request is in flight
+// until its response body is closed, so that long streaming responses count
+// towards their host's load.
+type LoadBalancer struct {
+	URLs         []*url.URL
+	Strategy     BalancingStrategy
+	RoundTripper RoundTripper
+
+	MaxErrorRate     float64
+	MinRequests      int
+	BaseEjectionTime time.Duration
+
+	lock  sync.Mutex
+	hosts []*balancedHost
+	next  int
+}
+
+type balancedHost struct {
+	url          *url.URL
+	outstanding  int
+	outcomes     []bool
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func (b *LoadBalancer) Next() *url.URL {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.init()
+
+	var candidates []*balancedHost
+	now := time.Now()
+	for _, host := range b.hosts {
+		if !now.Before(host.ejectedUntil) {
+			candidates = append(candidates, host)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = b.hosts
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var host *balancedHost
+	switch b.Strategy {
+	case PowerOfTwoChoices:
+		host = candidates[rand.IntN(len(candidates))]
+		if len(candidates) > 1 {
+			i := rand.IntN(len(candidates) - 1)
+			if candidates[i] == host {
+				i = len(candidates) - 1
+			}
+			if other := candidates[i]; other.outstanding < host.outstanding {
+				host = other
+			}
+		}
+	default:
+		// start at a rotating offset so ties are spread across hosts
+		start := b.next
+		b.next++
+		for i := range candidates {
+			candidate := candidates[(start+i)%len(candidates)]
+			if host == nil || candidate.outstanding < host.outstanding {
+				host = candidate
+			}
+		}
+	}
+
+	host.outstanding++
+
+	return host.url
+}
+
+func (b *LoadBalancer) Report(endpoint *url.URL, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.init()
+
+	for _, host := range b.hosts {
+		if endpointKey(host.url) == endpointKey(endpoint) {
+			b.record(host, err != nil)
+			return
+		}
+	}
+}
+
+func (b *LoadBalancer) RoundTrip(request *http.Request) (*http.Response, error) {
+	endpoint := b.Next()
+	if endpoint == nil {
+		return nil, errors.New("no hosts to balance across")
+	}
+
+	balanced := attemptRequest(request)
+	useEndpoint(balanced, endpoint)
+
+	response, err := b.RoundTripper.RoundTrip(balanced)
+	if err != nil {
+		b.Report(endpoint, attemptOutcome(request, nil, err))
+		return response, err
+	}
+
+	outcome := attemptOutcome(request, response, nil)
+	reportOnClose(response, func() { b.Report(endpoint, outcome) })
+
+	return response, nil
+}
+
+func (b *LoadBalancer) init() {
+	if b.hosts != nil {
+		return
+	}
+
+	for _, u := range b.URLs {
+		b.hosts = append(b.hosts, &balancedHost{url: u})
+	}
+}
+
+func (b *LoadBalancer) record(host *balancedHost, failed bool) {
+	if host.outstanding > 0 {
+		host.outstanding--
+	}
+
+	if len(host.outcomes) == outcomeWindow {
+		if host.outcomes[0] {
+			host.failures--
+		}
+		host.outcomes = host.outcomes[1:]
+	}
+
+	host.outcomes = append(host.outcomes, failed)
+	if failed {
+		host.failures++
+	}
+
+	maxErrorRate := b.MaxErrorRate
+	if maxErrorRate == 0 {
+		maxErrorRate = DefaultMaxErrorRate
+	}
+
+	minRequests := b.MinRequests
+	if minRequests == 0 {
+		minRequests = DefaultMinRequests
+	}
+
+	if len(host.outcomes) < minRequests {
+		return
+	}
+
+	if float64(host.failures)/float64(len(host.outcomes)) > maxErrorRate {
+		baseEjectionTime := b.BaseEjectionTime
+		if baseEjectionTime == 0 {
+			baseEjectionTime = DefaultBaseEjectionTime
+		}
+
+		host.ejections++
+		host.ejectedUntil = time.Now().Add(baseEjectionTime * time.Duration(host.ejections))
+		host.outcomes = nil
+		host.failures = 0
+	} else if len(host.outcomes) == outcomeWindow {
+		// a full window without ejection forgives past ejections
+		host.ejections = 0
+	}
+}
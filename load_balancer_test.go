@@ -0,0 +1,316 @@
+package retryhttp_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/cenkalti/backoff/v5"
+	"github.com/concourse/retryhttp"
+	"github.com/concourse/retryhttp/retryhttpfakes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LoadBalancer", func() {
+	var (
+		urls         []*url.URL
+		loadBalancer *retryhttp.LoadBalancer
+		disaster     error
+	)
+
+	BeforeEach(func() {
+		urls = []*url.URL{
+			{Scheme: "http", Host: "web-1"},
+			{Scheme: "http", Host: "web-2"},
+			{Scheme: "http", Host: "web-3"},
+		}
+		loadBalancer = &retryhttp.LoadBalancer{
+			URLs:             urls,
+			MinRequests:      3,
+			BaseEjectionTime: 100 * time.Millisecond,
+		}
+		disaster = errors.New("oh no!")
+	})
+
+	// completes returns the hosts used by n requests that complete with the
+	// given error before the next one starts
+	completes := func(n int, err error) []string {
+		var hosts []string
+		for range n {
+			endpoint := loadBalancer.Next()
+			loadBalancer.Report(endpoint, err)
+			hosts = append(hosts, endpoint.Host)
+		}
+		return hosts
+	}
+
+	fail := func(host *url.URL, n int) {
+		for range n {
+			loadBalancer.Report(host, disaster)
+		}
+	}
+
+	Context("with the least outstanding requests strategy", func() {
+		It("picks the host with the fewest requests in flight", func() {
+			Expect(loadBalancer.Next()).To(Equal(urls[0]))
+			Expect(loadBalancer.Next()).To(Equal(urls[1]))
+			Expect(loadBalancer.Next()).To(Equal(urls[2]))
+
+			loadBalancer.Report(urls[1], nil)
+			Expect(loadBalancer.Next()).To(Equal(urls[1]))
+		})
+
+		It("spreads sequential requests across hosts", func() {
+			Expect(completes(3, nil)).To(ConsistOf("web-1", "web-2", "web-3"))
+		})
+	})
+
+	Context("with the power of two choices strategy", func() {
+		BeforeEach(func() {
+			loadBalancer.URLs = urls[:2]
+			loadBalancer.Strategy = retryhttp.PowerOfTwoChoices
+		})
+
+		It("picks the less loaded of two hosts", func() {
+			first := loadBalancer.Next()
+			second := loadBalancer.Next()
+			Expect(second).NotTo(Equal(first))
+
+			loadBalancer.Report(first, nil)
+			Expect(loadBalancer.Next()).To(Equal(first))
+		})
+	})
+
+	Context("when a host's error rate exceeds the threshold", func() {
+		BeforeEach(func() {
+			fail(urls[0], 3)
+		})
+
+		It("ejects it", func() {
+			Expect(completes(6, nil)).NotTo(ContainElement("web-1"))
+		})
+
+		It("uses it again once the ejection period is over", func() {
+			time.Sleep(120 * time.Millisecond)
+			Expect(completes(3, nil)).To(ContainElement("web-1"))
+		})
+
+		It("ejects it for longer every time", func() {
+			time.Sleep(120 * time.Millisecond)
+			fail(urls[0], 3)
+
+			time.Sleep(120 * time.Millisecond)
+			Expect(completes(6, nil)).NotTo(ContainElement("web-1"))
+
+			time.Sleep(120 * time.Millisecond)
+			Expect(completes(3, nil)).To(ContainElement("web-1"))
+		})
+	})
+
+	Context("when a host's error rate is below the threshold", func() {
+		BeforeEach(func() {
+			loadBalancer.Report(urls[0], nil)
+			loadBalancer.Report(urls[0], nil)
+			fail(urls[0], 1)
+		})
+
+		It("keeps using it", func() {
+			Expect(completes(3, nil)).To(ContainElement("web-1"))
+		})
+	})
+
+	Context("when every host is ejected", func() {
+		BeforeEach(func() {
+			for _, u := range urls {
+				fail(u, 3)
+			}
+		})
+
+		It("uses all of them", func() {
+			Expect(completes(3, nil)).To(ConsistOf("web-1", "web-2", "web-3"))
+		})
+	})
+
+	Context("as a RoundTripper", func() {
+		var fakeRoundTripper *retryhttpfakes.FakeRoundTripper
+
+		BeforeEach(func() {
+			fakeRoundTripper = new(retryhttpfakes.FakeRoundTripper)
+			fakeRoundTripper.RoundTripStub = func(request *http.Request) (*http.Response, error) {
+				if request.URL.Host == "web-1" {
+					return &http.Response{StatusCode: http.StatusBadGateway}, nil
+				}
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			}
+			loadBalancer.RoundTripper = fakeRoundTripper
+		})
+
+		It("sends requests to the picked host", func() {
+			request, err := http.NewRequest("GET", "http://atc/api/v1/info", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			for range 3 {
+				_, err := loadBalancer.RoundTrip(request)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			var hosts []string
+			for i := range fakeRoundTripper.RoundTripCallCount() {
+				sent := fakeRoundTripper.RoundTripArgsForCall(i)
+				Expect(sent.URL.Path).To(Equal("/api/v1/info"))
+				hosts = append(hosts, sent.Host)
+			}
+			Expect(hosts).To(ConsistOf("web-1", "web-2", "web-3"))
+			Expect(request.URL.Host).To(Equal("atc"))
+		})
+
+		It("counts requests as in flight until their response body is closed", func() {
+			loadBalancer.URLs = urls[:2]
+			fakeRoundTripper.RoundTripStub = func(request *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("stream"))}, nil
+			}
+
+			request, err := http.NewRequest("GET", "http://atc/api/v1/info", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			streaming, err := loadBalancer.RoundTrip(request)
+			Expect(err).NotTo(HaveOccurred())
+			defer streaming.Body.Close()
+
+			for range 3 {
+				response, err := loadBalancer.RoundTrip(request)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response.Body.Close()).To(Succeed())
+			}
+
+			var hosts []string
+			for i := range fakeRoundTripper.RoundTripCallCount() {
+				hosts = append(hosts, fakeRoundTripper.RoundTripArgsForCall(i).Host)
+			}
+			Expect(hosts).To(Equal([]string{"web-1", "web-2", "web-2", "web-2"}))
+		})
+
+		It("counts server errors as failures", func() {
+			request, err := http.NewRequest("GET", "http://atc/api/v1/info", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			for range 9 {
+				_, err := loadBalancer.RoundTrip(request)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			for range 6 {
+				response, err := loadBalancer.RoundTrip(request)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response.StatusCode).To(Equal(http.StatusOK))
+			}
+		})
+	})
+
+	Context("as the endpoints of a RetryRoundTripper", func() {
+		var fakeRoundTripper *retryhttpfakes.FakeRoundTripper
+
+		BeforeEach(func() {
+			loadBalancer.URLs = urls[:2]
+			loadBalancer.MinRequests = 1
+
+			fakeRoundTripper = new(retryhttpfakes.FakeRoundTripper)
+			fakeRoundTripper.RoundTripStub = func(request *http.Request) (*http.Response, error) {
+				if request.URL.Host == "web-1" {
+					return nil, syscall.ECONNREFUSED
+				}
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			}
+		})
+
+		It("ejects hosts based on the outcome of attempts", func() {
+			fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+			fakeBackOffFactory.NewBackOffReturns(new(retryhttpfakes.FakeBackOff))
+			fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+			retryRoundTripper := &retryhttp.RetryRoundTripper{
+				Logger:         lager.NewLogger("test"),
+				BackOffFactory: fakeBackOffFactory,
+				RoundTripper:   fakeRoundTripper,
+				Endpoints:      loadBalancer,
+			}
+
+			request, err := http.NewRequest("GET", "http://atc/api/v1/info", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			response, err := retryRoundTripper.RoundTrip(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+
+			Expect(completes(3, nil)).To(Equal([]string{"web-2", "web-2", "web-2"}))
+		})
+
+		It("ejects hosts that answer with server errors", func() {
+			fakeRoundTripper.RoundTripStub = func(request *http.Request) (*http.Response, error) {
+				if request.URL.Host == "web-1" {
+					return &http.Response{StatusCode: http.StatusInternalServerError}, nil
+				}
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			}
+
+			fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+			fakeBackOffFactory.NewBackOffReturns(new(retryhttpfakes.FakeBackOff))
+			fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+			retryRoundTripper := &retryhttp.RetryRoundTripper{
+				Logger:         lager.NewLogger("test"),
+				BackOffFactory: fakeBackOffFactory,
+				RoundTripper:   fakeRoundTripper,
+				Endpoints:      loadBalancer,
+			}
+
+			request, err := http.NewRequest("GET", "http://atc/api/v1/info", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			response, err := retryRoundTripper.RoundTrip(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusInternalServerError))
+
+			Expect(completes(3, nil)).To(Equal([]string{"web-2", "web-2", "web-2"}))
+		})
+
+		It("counts attempts as in flight until their response body is closed", func() {
+			fakeRoundTripper.RoundTripStub = func(request *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("stream"))}, nil
+			}
+
+			fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+			fakeBackOffFactory.NewBackOffReturns(new(retryhttpfakes.FakeBackOff))
+			fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+			retryRoundTripper := &retryhttp.RetryRoundTripper{
+				Logger:         lager.NewLogger("test"),
+				BackOffFactory: fakeBackOffFactory,
+				RoundTripper:   fakeRoundTripper,
+				Endpoints:      loadBalancer,
+			}
+
+			request, err := http.NewRequest("GET", "http://atc/api/v1/info", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			streaming, err := retryRoundTripper.RoundTrip(request)
+			Expect(err).NotTo(HaveOccurred())
+
+			response, err := retryRoundTripper.RoundTrip(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.Body.Close()).To(Succeed())
+
+			Expect(completes(2, nil)).To(Equal([]string{"web-2", "web-2"}))
+
+			Expect(streaming.Body.Close()).To(Succeed())
+			Expect(completes(2, nil)).To(ConsistOf("web-1", "web-2"))
+		})
+	})
+})
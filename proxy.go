@@ -0,0 +1,139 @@
+package retryhttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialTarget connects to the address the request is for, through the proxy
+// chosen by Proxy if there is one. Unix sockets are always dialed directly.
+func (c *BasicHijackableClient) dialTarget(ctx context.Context, req *http.Request, network, addr string) (net.Conn, error) {
+	if c.Proxy == nil || network != "tcp" {
+		return c.dial(ctx, network, addr)
+	}
+
+	proxyURL, err := c.Proxy(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL == nil {
+		return c.dial(ctx, network, addr)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return c.dialConnect(ctx, proxyURL, addr)
+	case "socks5", "socks5h":
+		return c.dialSOCKS5(ctx, proxyURL, addr)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+}
+
+// dialConnect opens a tunnel to addr with a CONNECT request to the proxy.
+// An https proxy is spoken to over TLS, verified with TLSConfig against the
+// proxy's host name.
+func (c *BasicHijackableClient) dialConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := c.dial(ctx, "tcp", canonicalAddr(proxyURL))
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL.Scheme == "https" {
+		config := c.tlsConfig()
+		config.ServerName = proxyURL.Hostname()
+
+		conn, err = c.handshake(ctx, conn, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
+	reader := bufio.NewReader(conn)
+
+	var connectResp *http.Response
+	err = connectReq.Write(conn)
+	if err == nil {
+		connectResp, err = http.ReadResponse(reader, connectReq)
+	}
+
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	connectResp.Body.Close()
+
+	if connectResp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused to connect to %s: %s", addr, connectResp.Status)
+	}
+
+	// the target has not been sent anything yet, so it can not have answered
+	if reader.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy sent unexpected data after connecting to %s", addr)
+	}
+
+	return conn, nil
+}
+
+// dialSOCKS5 connects to addr through a SOCKS5 proxy, which resolves the
+// host name.
+func (c *BasicHijackableClient) dialSOCKS5(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if user := proxyURL.User; user != nil {
+		auth = &proxy.Auth{User: user.Username()}
+		auth.Password, _ = user.Password()
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", canonicalAddr(proxyURL), auth, proxyForwarder{c})
+	if err != nil {
+		return nil, err
+	}
+
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
+
+// proxyForwarder dials proxies the way the client dials everything else.
+type proxyForwarder struct {
+	client *BasicHijackableClient
+}
+
+func (f proxyForwarder) Dial(network, addr string) (net.Conn, error) {
+	return f.client.dial(context.Background(), network, addr)
+}
+
+func (f proxyForwarder) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f.client.dial(ctx, network, addr)
+}
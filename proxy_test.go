@@ -0,0 +1,285 @@
+package retryhttp_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+
+	"github.com/concourse/retryhttp"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BasicHijackableClient through a proxy", func() {
+	var (
+		target           *httptest.Server
+		hijackableClient *retryhttp.BasicHijackableClient
+		request          *http.Request
+		proxyURL         *url.URL
+	)
+
+	BeforeEach(func() {
+		target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}))
+
+		hijackableClient = &retryhttp.BasicHijackableClient{
+			DialContext:           (&net.Dialer{}).DialContext,
+			DoHijackCloserFactory: retryhttp.DefaultDoHijackCloserFactory,
+			Proxy: func(*http.Request) (*url.URL, error) {
+				return proxyURL, nil
+			},
+		}
+
+		var err error
+		request, err = http.NewRequest("GET", target.URL, nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		target.Close()
+	})
+
+	expectTeapot := func() {
+		response, hijackCloser, err := hijackableClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer hijackCloser.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusTeapot))
+	}
+
+	Context("with an HTTP proxy", func() {
+		var (
+			proxy         *httptest.Server
+			connectedTo   chan string
+			authorization chan string
+			proxyStatus   int
+		)
+
+		BeforeEach(func() {
+			connectedTo = make(chan string, 1)
+			authorization = make(chan string, 1)
+			proxyStatus = http.StatusOK
+
+			proxy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.Method).To(Equal(http.MethodConnect))
+
+				connectedTo <- r.Host
+				authorization <- r.Header.Get("Proxy-Authorization")
+
+				if proxyStatus != http.StatusOK {
+					w.WriteHeader(proxyStatus)
+					return
+				}
+
+				upstream, err := net.Dial("tcp", r.Host)
+				Expect(err).NotTo(HaveOccurred())
+
+				conn, buffered, err := http.NewResponseController(w).Hijack()
+				Expect(err).NotTo(HaveOccurred())
+
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				pipe(conn, buffered, upstream)
+			}))
+
+			var err error
+			proxyURL, err = url.Parse(proxy.URL)
+			Expect(err).NotTo(HaveOccurred())
+			proxyURL.User = url.UserPassword("worker", "s3cret")
+		})
+
+		AfterEach(func() {
+			proxy.Close()
+		})
+
+		It("tunnels the request with CONNECT", func() {
+			expectTeapot()
+			Expect(connectedTo).To(Receive(Equal(target.Listener.Addr().String())))
+			Expect(authorization).To(Receive(Equal("Basic d29ya2VyOnMzY3JldA==")))
+		})
+
+		Context("when the target is https", func() {
+			BeforeEach(func() {
+				target.Close()
+				target = httptest.NewTLSServer(target.Config.Handler)
+
+				roots := x509.NewCertPool()
+				roots.AddCert(target.Certificate())
+				hijackableClient.TLSConfig = &tls.Config{RootCAs: roots}
+
+				var err error
+				request, err = http.NewRequest("GET", target.URL, nil)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("does the handshake with the target through the tunnel", func() {
+				expectTeapot()
+				Expect(connectedTo).To(Receive(Equal(target.Listener.Addr().String())))
+			})
+		})
+
+		Context("when the proxy is https", func() {
+			BeforeEach(func() {
+				proxy.Close()
+				proxy = httptest.NewTLSServer(proxy.Config.Handler)
+
+				roots := x509.NewCertPool()
+				roots.AddCert(proxy.Certificate())
+				hijackableClient.TLSConfig = &tls.Config{RootCAs: roots}
+
+				var err error
+				proxyURL, err = url.Parse(proxy.URL)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("tunnels the request over TLS", func() {
+				expectTeapot()
+				Expect(connectedTo).To(Receive(Equal(target.Listener.Addr().String())))
+			})
+		})
+
+		Context("when the proxy refuses", func() {
+			BeforeEach(func() {
+				proxyStatus = http.StatusProxyAuthRequired
+			})
+
+			It("returns an error", func() {
+				_, _, err := hijackableClient.Do(request)
+				Expect(err).To(MatchError(ContainSubstring("407 Proxy Authentication Required")))
+			})
+		})
+
+		Context("when no proxy is chosen for the request", func() {
+			BeforeEach(func() {
+				hijackableClient.Proxy = func(*http.Request) (*url.URL, error) {
+					return nil, nil
+				}
+			})
+
+			It("connects directly", func() {
+				expectTeapot()
+				Expect(connectedTo).NotTo(Receive())
+			})
+		})
+	})
+
+	Context("with a SOCKS5 proxy", func() {
+		var (
+			listener    net.Listener
+			connectedTo chan string
+			credentials chan string
+		)
+
+		BeforeEach(func() {
+			connectedTo = make(chan string, 1)
+			credentials = make(chan string, 1)
+
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			go serveSOCKS5(listener, connectedTo, credentials)
+
+			proxyURL = &url.URL{
+				Scheme: "socks5",
+				Host:   listener.Addr().String(),
+				User:   url.UserPassword("worker", "s3cret"),
+			}
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("connects through it", func() {
+			expectTeapot()
+			Expect(connectedTo).To(Receive(Equal(target.Listener.Addr().String())))
+			Expect(credentials).To(Receive(Equal("worker:s3cret")))
+		})
+	})
+})
+
+// pipe copies between the client and upstream connections until either side
+// is done.
+func pipe(client net.Conn, buffered *bufio.ReadWriter, upstream net.Conn) {
+	defer client.Close()
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// serveSOCKS5 is a minimal SOCKS5 server requiring username and password
+// authentication and supporting only CONNECT.
+func serveSOCKS5(listener net.Listener, connectedTo chan<- string, credentials chan<- string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer GinkgoRecover()
+
+			reader := bufio.NewReader(conn)
+			readBytes := func(n int) []byte {
+				buf := make([]byte, n)
+				_, err := io.ReadFull(reader, buf)
+				Expect(err).NotTo(HaveOccurred())
+				return buf
+			}
+
+			// greeting: version, methods
+			greeting := readBytes(2)
+			Expect(greeting[0]).To(BeEquivalentTo(5))
+			Expect(readBytes(int(greeting[1]))).To(ContainElement(byte(2)))
+			conn.Write([]byte{5, 2})
+
+			// username/password authentication
+			Expect(readBytes(1)).To(Equal([]byte{1}))
+			username := readBytes(int(readBytes(1)[0]))
+			password := readBytes(int(readBytes(1)[0]))
+			credentials <- string(username) + ":" + string(password)
+			conn.Write([]byte{1, 0})
+
+			// request: version, command, reserved, address type
+			header := readBytes(4)
+			Expect(header[:3]).To(Equal([]byte{5, 1, 0}))
+
+			var host string
+			switch header[3] {
+			case 1:
+				host = net.IP(readBytes(4)).String()
+			case 3:
+				host = string(readBytes(int(readBytes(1)[0])))
+			default:
+				Fail("unsupported address type")
+			}
+			port := binary.BigEndian.Uint16(readBytes(2))
+
+			addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+			connectedTo <- addr
+
+			upstream, err := net.Dial("tcp", addr)
+			Expect(err).NotTo(HaveOccurred())
+
+			conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			pipe(conn, bufio.NewReadWriter(reader, bufio.NewWriter(conn)), upstream)
+		}()
+	}
+}
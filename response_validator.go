@@ -0,0 +1,64 @@
+package retryhttp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ResponseValidator inspects a response, along with up to
+// ValidatorPrefixSize bytes from the start of its body, and decides whether
+// it should be retried, e.g. because a proxy answered with an HTML error page.
+// The reason is logged and ends up in the final InvalidResponseError.
+type ResponseValidator func(response *http.Response, prefix []byte) (retry bool, reason string)
+
+// InvalidResponseError is returned when every response was rejected by the
+// ResponseValidator.
+type InvalidResponseError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *InvalidResponseError) Error() string {
+	return fmt.Sprintf("invalid response with status %d: %s", e.StatusCode, e.Reason)
+}
+
+// validateResponse runs the validator on the response. A rejected response
+// is drained and closed. An accepted response is returned with the prefix
+// given to the validator put back in front of its body.
+func validateResponse(response *http.Response, validator ResponseValidator, prefixSize int) (*http.Response, error) {
+	var prefix []byte
+	if prefixSize > 0 {
+		prefix = make([]byte, prefixSize)
+
+		n, err := io.ReadFull(response.Body, prefix)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			response.Body.Close()
+			return nil, err
+		}
+
+		prefix = prefix[:n]
+	}
+
+	retry, reason := validator(response, prefix)
+	if retry {
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+
+		return nil, &InvalidResponseError{
+			StatusCode: response.StatusCode,
+			Reason:     reason,
+		}
+	}
+
+	if len(prefix) > 0 {
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(prefix), response.Body), response.Body}
+	}
+
+	return response, nil
+}
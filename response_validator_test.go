@@ -0,0 +1,170 @@
+package retryhttp_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	"github.com/cenkalti/backoff/v5"
+	"github.com/concourse/retryhttp"
+	"github.com/concourse/retryhttp/retryhttpfakes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ResponseValidator", func() {
+	var (
+		fakeRoundTripper  *retryhttpfakes.FakeRoundTripper
+		fakeBackOff       *retryhttpfakes.FakeBackOff
+		logger            *lagertest.TestLogger
+		retryRoundTripper *retryhttp.RetryRoundTripper
+		htmlPage          *trackingBody
+		request           *http.Request
+		response          *http.Response
+		roundTripErr      error
+	)
+
+	BeforeEach(func() {
+		fakeRoundTripper = new(retryhttpfakes.FakeRoundTripper)
+		fakeBackOff = new(retryhttpfakes.FakeBackOff)
+		fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+		fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+		fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+		logger = lagertest.NewTestLogger("test")
+
+		retryRoundTripper = &retryhttp.RetryRoundTripper{
+			Logger:         logger,
+			BackOffFactory: fakeBackOffFactory,
+			RoundTripper:   fakeRoundTripper,
+			ResponseValidator: func(response *http.Response, prefix []byte) (bool, string) {
+				if bytes.HasPrefix(prefix, []byte("<html>")) {
+					return true, "proxy error page"
+				}
+				return false, ""
+			},
+			ValidatorPrefixSize: 6,
+		}
+
+		htmlPage = &trackingBody{Reader: strings.NewReader("<html>bad gateway</html>")}
+		fakeRoundTripper.RoundTripReturnsOnCall(0, &http.Response{StatusCode: http.StatusOK, Body: htmlPage}, nil)
+		fakeRoundTripper.RoundTripReturnsOnCall(1, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"ok":true}`))}, nil)
+
+		request = &http.Request{Method: "GET"}
+	})
+
+	JustBeforeEach(func() {
+		response, roundTripErr = retryRoundTripper.RoundTrip(request)
+	})
+
+	It("retries rejected responses", func() {
+		Expect(roundTripErr).NotTo(HaveOccurred())
+		Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+	})
+
+	It("drains and closes the rejected response", func() {
+		Expect(htmlPage.Len()).To(BeZero())
+		Expect(htmlPage.closed).To(BeTrue())
+	})
+
+	It("returns the accepted response with its whole body", func() {
+		Expect(io.ReadAll(response.Body)).To(Equal([]byte(`{"ok":true}`)))
+	})
+
+	It("logs the reason", func() {
+		Expect(logger.Logs()).To(HaveLen(1))
+		Expect(logger.Logs()[0].Data).To(HaveKeyWithValue("reason", "proxy error page"))
+	})
+
+	Context("when the body is shorter than the prefix", func() {
+		BeforeEach(func() {
+			fakeRoundTripper.RoundTripReturnsOnCall(0, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok"))}, nil)
+		})
+
+		It("validates what there is", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+			Expect(io.ReadAll(response.Body)).To(Equal([]byte("ok")))
+		})
+	})
+
+	Context("when the request's body was sent", func() {
+		BeforeEach(func() {
+			fakeRoundTripper.RoundTripStub = func(attempt *http.Request) (*http.Response, error) {
+				io.ReadAll(attempt.Body)
+				if fakeRoundTripper.RoundTripCallCount() == 1 {
+					return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("<html>"))}, nil
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"ok":true}`))}, nil
+			}
+
+			request = &http.Request{
+				Body: io.NopCloser(strings.NewReader("payload")),
+				GetBody: func() (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader("payload")), nil
+				},
+			}
+		})
+
+		Context("with an idempotent method", func() {
+			BeforeEach(func() {
+				request.Method = "PUT"
+			})
+
+			It("sends it again", func() {
+				Expect(roundTripErr).NotTo(HaveOccurred())
+				Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+			})
+		})
+
+		Context("with a method that is not idempotent", func() {
+			BeforeEach(func() {
+				request.Method = "POST"
+			})
+
+			It("does not send it again", func() {
+				Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+				Expect(roundTripErr).To(MatchError(&retryhttp.InvalidResponseError{
+					StatusCode: http.StatusOK,
+					Reason:     "proxy error page",
+				}))
+			})
+		})
+	})
+
+	Context("when every response is rejected", func() {
+		BeforeEach(func() {
+			fakeRoundTripper.RoundTripStub = func(*http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("<html>"))}, nil
+			}
+			fakeBackOff.NextBackOffStub = func() time.Duration {
+				if fakeBackOff.NextBackOffCallCount() >= 2 {
+					return backoff.Stop
+				}
+				return 0
+			}
+		})
+
+		It("returns an error with the validator's reason", func() {
+			Expect(response).To(BeNil())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+			Expect(roundTripErr).To(MatchError(&retryhttp.InvalidResponseError{
+				StatusCode: http.StatusOK,
+				Reason:     "proxy error page",
+			}))
+			Expect(roundTripErr).To(MatchError(ContainSubstring("proxy error page")))
+		})
+	})
+})
+
+type trackingBody struct {
+	*strings.Reader
+	closed bool
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return nil
+}
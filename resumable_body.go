@@ -0,0 +1,280 @@
+package retryhttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v5"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// ResumeFunc builds the request that continues the response to the given
+// request after consumed bytes of its body were read, e.g. by setting an
+// offset or cursor query parameter. Consumers of event streams can resume
+// from the last event they processed instead of relying on consumed.
+type ResumeFunc func(request *http.Request, consumed int64) (*http.Request, error)
+
+// ResumableRoundTripper resumes response bodies that fail mid-stream with a
+// retryable error by sending the request built by Resume through the
+// RetryRoundTripper and splicing its response body onto what was already
+// read. Resumed responses are accepted if Validate, or by default a 2xx
+// status, approves them.
+type ResumableRoundTripper struct {
+	RetryRoundTripper *RetryRoundTripper
+	Resume            ResumeFunc
+	Validate          func(response *http.Response, consumed int64) error
+}
+
+func (d *ResumableRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := d.RetryRoundTripper.roundTrip(request)
+	if err != nil || response.StatusCode < 200 || response.StatusCode > 299 {
+		return response, err
+	}
+
+	validate := d.Validate
+	if validate == nil {
+		validate = validateSuccess
+	}
+
+	response.Body = &resumableBody{
+		logger:       d.RetryRoundTripper.Logger,
+		roundTripper: d.RetryRoundTripper,
+		request:      request,
+		body:         response.Body,
+		newRequest:   d.Resume,
+		validate:     validate,
+	}
+
+	return response, nil
+}
+
+// ErrNotResumed is returned when the server answers a resume request with
+// something that can not be spliced onto what was already read, e.g. because
+// the resource changed in the meantime.
+var ErrNotResumed = errors.New("response can not be resumed")
+
+// resumableBody reads a response body and, when reading fails with a
+// retryable error, issues a new request continuing from the number of bytes
+// read so far and carries on reading from its response.
+type resumableBody struct {
+	logger       lager.Logger
+	roundTripper *RetryRoundTripper
+	request      *http.Request
+	body         io.ReadCloser
+	offset       int64
+
+	newRequest ResumeFunc
+	validate   func(response *http.Response, offset int64) error
+
+	// readErr is a retryable error that broke the body after it returned
+	// some bytes, to be resumed from on the next Read
+	readErr error
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	readErr := b.readErr
+	b.readErr = nil
+
+	if readErr == nil {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+
+		if !b.resumable(err) {
+			return n, err
+		}
+
+		if n > 0 {
+			b.readErr = err
+			return n, nil
+		}
+
+		readErr = err
+	}
+
+	return b.resume(p, readErr)
+}
+
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
+
+// resumable reports whether the body should be resumed after a read failed
+// with err.
+func (b *resumableBody) resumable(err error) bool {
+	if err == nil || err == io.EOF || b.request.Context().Err() != nil {
+		return false
+	}
+
+	return decide(b.roundTripper.retryer(), err).Retry
+}
+
+// resume resumes the body until a continuation returns bytes into p. The
+// failed read counts as the first attempt, and resumes that break before
+// making any progress as further attempts, so a stream that keeps breaking
+// right away gives up once the backoff policy ends.
+func (b *resumableBody) resume(p []byte, readErr error) (int, error) {
+	attempted := false
+
+	return backoff.Retry(b.request.Context(), func() (int, error) {
+		if !attempted {
+			attempted = true
+			return 0, readErr
+		}
+
+		request, err := b.newRequest(b.request, b.offset)
+		if err != nil {
+			return 0, backoff.Permanent(fmt.Errorf("resume at byte %d after %w: %w", b.offset, readErr, err))
+		}
+
+		response, err := b.roundTripper.roundTrip(request)
+		if err != nil {
+			return 0, backoff.Permanent(fmt.Errorf("resume at byte %d after %w: %w", b.offset, readErr, err))
+		}
+
+		if err := b.validate(response, b.offset); err != nil {
+			response.Body.Close()
+			return 0, backoff.Permanent(fmt.Errorf("resume at byte %d after %w: %w", b.offset, readErr, err))
+		}
+
+		b.body.Close()
+		b.body = response.Body
+
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+
+		switch {
+		case !b.resumable(err):
+			return n, backoff.Permanent(err)
+		case n > 0:
+			b.readErr = err
+			return n, nil
+		default:
+			return 0, err
+		}
+	},
+		backoff.WithBackOff(b.roundTripper.BackOffFactory.NewBackOff()),
+		backoff.WithNotify(func(err error, next time.Duration) {
+			b.logger.Info("resuming", lager.Data{
+				"offset": b.offset,
+				"error":  err.Error(),
+				"after":  next.String(),
+			})
+		}),
+		b.roundTripper.BackOffFactory.WithMaxElapsedTime(),
+	)
+}
+
+// resumableDownload reports whether a response to a GET request can be
+// resumed with a Range request guarded by If-Range. Responses the transport
+// decompressed can not, as ranges count bytes of the compressed body.
+func resumableDownload(request *http.Request, response *http.Response) bool {
+	if request.Method != "" && request.Method != http.MethodGet {
+		return false
+	}
+
+	if response.Uncompressed {
+		return false
+	}
+
+	if request.Header.Get("Range") != "" || response.StatusCode != http.StatusOK {
+		return false
+	}
+
+	if response.Header.Get("Accept-Ranges") == "none" {
+		return false
+	}
+
+	return rangeValidator(response) != ""
+}
+
+// rangeValidator returns the validator used in If-Range to make sure the
+// continuation belongs to the same representation. Weak ETags can not be
+// used with If-Range.
+func rangeValidator(response *http.Response) string {
+	if etag := response.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return response.Header.Get("Last-Modified")
+}
+
+func validateSuccess(response *http.Response, _ int64) error {
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%w: status %d", ErrNotResumed, response.StatusCode)
+	}
+
+	return nil
+}
+
+func newRangeRequest(validator string) ResumeFunc {
+	return func(request *http.Request, offset int64) (*http.Request, error) {
+		rangeRequest := request.Clone(request.Context())
+		rangeRequest.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		rangeRequest.Header.Set("If-Range", validator)
+		return rangeRequest, nil
+	}
+}
+
+func validateRangeResponse(size int64) func(*http.Response, int64) error {
+	return func(response *http.Response, offset int64) error {
+		if response.StatusCode != http.StatusPartialContent {
+			return fmt.Errorf("%w: status %d", ErrNotResumed, response.StatusCode)
+		}
+
+		start, total, err := parseContentRange(response.Header.Get("Content-Range"))
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrNotResumed, err)
+		}
+
+		if start != offset {
+			return fmt.Errorf("%w: range starts at byte %d instead of %d", ErrNotResumed, start, offset)
+		}
+
+		if size >= 0 && total >= 0 && total != size {
+			return fmt.Errorf("%w: size changed from %d to %d bytes", ErrNotResumed, size, total)
+		}
+
+		return nil
+	}
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes start-end/total". The total is -1 if it is unknown.
+func parseContentRange(value string) (int64, int64, error) {
+	spec, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+
+	byteRange, size, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+
+	first, _, found := strings.Cut(byteRange, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+
+	if size == "*" {
+		return start, -1, nil
+	}
+
+	total, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+
+	return start, total, nil
+}
@@ -0,0 +1,439 @@
+package retryhttp_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/cenkalti/backoff/v5"
+	"github.com/concourse/retryhttp"
+	"github.com/concourse/retryhttp/retryhttpfakes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resumable downloads", func() {
+	var (
+		data              []byte
+		etag              string
+		brokenResponses   int
+		gzipped           bool
+		stalled           bool
+		requestHeaders    []http.Header
+		lock              sync.Mutex
+		server            *httptest.Server
+		transport         *http.Transport
+		retryRoundTripper *retryhttp.RetryRoundTripper
+		request           *http.Request
+	)
+
+	BeforeEach(func() {
+		data = bytes.Repeat([]byte("0123456789"), 100_000)
+		etag = `"v1"`
+		brokenResponses = 1
+		gzipped = false
+		stalled = false
+		requestHeaders = nil
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			requestHeaders = append(requestHeaders, r.Header.Clone())
+			broken := len(requestHeaders) <= brokenResponses
+			currentETag := etag
+			lock.Unlock()
+
+			w.Header().Set("ETag", currentETag)
+
+			if !broken {
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+				return
+			}
+
+			body := data
+			if gzipped {
+				var compressed bytes.Buffer
+				writer := gzip.NewWriter(&compressed)
+				writer.Write(data)
+				writer.Close()
+
+				body = compressed.Bytes()
+				w.Header().Set("Content-Encoding", "gzip")
+			}
+
+			// send part of what was asked for and hang up
+			start := 0
+			if r.Header.Get("Range") != "" {
+				fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)-start))
+				w.WriteHeader(http.StatusPartialContent)
+			} else {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				w.WriteHeader(http.StatusOK)
+			}
+
+			end := start + len(body)/4
+			if stalled && start > 0 {
+				end = start
+			}
+			w.Write(body[start:end])
+			w.(http.Flusher).Flush()
+
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}))
+
+		transport = &http.Transport{}
+
+		fakeBackOff := new(retryhttpfakes.FakeBackOff)
+		fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+		fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+		fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+		retryRoundTripper = &retryhttp.RetryRoundTripper{
+			Logger:          lager.NewLogger("test"),
+			BackOffFactory:  fakeBackOffFactory,
+			RoundTripper:    transport,
+			ResumeDownloads: true,
+		}
+
+		var err error
+		request, err = http.NewRequest("GET", server.URL, nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		transport.CloseIdleConnections()
+		server.Close()
+	})
+
+	readBody := func() ([]byte, error) {
+		response, err := retryRoundTripper.RoundTrip(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+
+		return io.ReadAll(response.Body)
+	}
+
+	It("resumes from where the broken stream left off", func() {
+		body, err := readBody()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal(data))
+
+		Expect(requestHeaders).To(HaveLen(2))
+		Expect(requestHeaders[1].Get("Range")).To(Equal("bytes=" + strconv.Itoa(len(data)/4) + "-"))
+		Expect(requestHeaders[1].Get("If-Range")).To(Equal(`"v1"`))
+	})
+
+	It("does not modify the caller's request", func() {
+		_, err := readBody()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(request.Header.Get("Range")).To(BeEmpty())
+	})
+
+	Context("when the continuation breaks as well", func() {
+		BeforeEach(func() {
+			brokenResponses = 2
+		})
+
+		It("keeps resuming", func() {
+			body, err := readBody()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(body).To(Equal(data))
+
+			Expect(requestHeaders).To(HaveLen(3))
+			Expect(requestHeaders[2].Get("Range")).To(Equal("bytes=" + strconv.Itoa(len(data)/2) + "-"))
+		})
+	})
+
+	Context("when the continuations keep breaking right away", func() {
+		BeforeEach(func() {
+			brokenResponses = 100
+			stalled = true
+			retryRoundTripper.BackOffFactory = retryhttp.NewExponentialBackOffFactory(2 * time.Second)
+		})
+
+		It("gives up once the backoff policy's max elapsed time has passed", func() {
+			var err error
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				_, err = readBody()
+			}()
+
+			Eventually(done, 10*time.Second).Should(BeClosed())
+			Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+
+			lock.Lock()
+			defer lock.Unlock()
+			Expect(len(requestHeaders)).To(BeNumerically("<=", 4))
+		})
+	})
+
+	Context("when the transport decompressed the response", func() {
+		BeforeEach(func() {
+			gzipped = true
+		})
+
+		It("does not resume", func() {
+			_, err := readBody()
+			Expect(err).To(HaveOccurred())
+			Expect(requestHeaders).To(HaveLen(1))
+		})
+	})
+
+	Context("when the resource changes before resuming", func() {
+		BeforeEach(func() {
+			retryRoundTripper.RoundTripper = &changingRoundTripper{
+				RoundTripper: transport,
+				change: func() {
+					lock.Lock()
+					etag = `"v2"`
+					lock.Unlock()
+				},
+			}
+		})
+
+		It("fails instead of splicing different content", func() {
+			_, err := readBody()
+			Expect(err).To(MatchError(retryhttp.ErrNotResumed))
+		})
+	})
+
+	Context("when the response has no validator", func() {
+		BeforeEach(func() {
+			etag = ""
+		})
+
+		It("does not resume", func() {
+			_, err := readBody()
+			Expect(err).To(HaveOccurred())
+			Expect(requestHeaders).To(HaveLen(1))
+		})
+	})
+
+	Context("when resuming is disabled", func() {
+		BeforeEach(func() {
+			retryRoundTripper.ResumeDownloads = false
+		})
+
+		It("does not resume", func() {
+			_, err := readBody()
+			Expect(err).To(HaveOccurred())
+			Expect(requestHeaders).To(HaveLen(1))
+		})
+	})
+
+	Context("when the request is not a GET", func() {
+		BeforeEach(func() {
+			request.Method = "POST"
+		})
+
+		It("does not resume", func() {
+			_, err := readBody()
+			Expect(err).To(HaveOccurred())
+			Expect(requestHeaders).To(HaveLen(1))
+		})
+	})
+})
+
+// changingRoundTripper calls change before every request but the first.
+type changingRoundTripper struct {
+	http.RoundTripper
+	change   func()
+	requests int
+}
+
+func (rt *changingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	rt.requests++
+	if rt.requests > 1 {
+		rt.change()
+	}
+	return rt.RoundTripper.RoundTrip(request)
+}
+
+var _ = Describe("ResumableRoundTripper", func() {
+	var (
+		lines               []string
+		resumesBreak        bool
+		offsets             []string
+		lock                sync.Mutex
+		server              *httptest.Server
+		transport           *http.Transport
+		resumableRoundTrip  *retryhttp.ResumableRoundTripper
+		consumedWhenResumed []int64
+	)
+
+	BeforeEach(func() {
+		lines = []string{"first\n", "second\n", "third\n", "fourth\n"}
+		resumesBreak = false
+		offsets = nil
+		consumedWhenResumed = nil
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			offsets = append(offsets, r.URL.Query().Get("offset"))
+			firstRequest := len(offsets) == 1
+			lock.Unlock()
+
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			stream := strings.Join(lines, "")[offset:]
+
+			if !firstRequest && !resumesBreak {
+				io.WriteString(w, stream)
+				return
+			}
+
+			// send the first two lines of a chunked stream, or nothing when
+			// resuming, and hang up
+			if firstRequest {
+				io.WriteString(w, lines[0]+lines[1])
+			}
+			w.(http.Flusher).Flush()
+
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}))
+
+		transport = &http.Transport{}
+
+		fakeBackOff := new(retryhttpfakes.FakeBackOff)
+		fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+		fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+		fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+		resumableRoundTrip = &retryhttp.ResumableRoundTripper{
+			RetryRoundTripper: &retryhttp.RetryRoundTripper{
+				Logger:         lager.NewLogger("test"),
+				BackOffFactory: fakeBackOffFactory,
+				RoundTripper:   transport,
+			},
+			Resume: func(request *http.Request, consumed int64) (*http.Request, error) {
+				consumedWhenResumed = append(consumedWhenResumed, consumed)
+
+				resumeRequest := request.Clone(request.Context())
+				query := resumeRequest.URL.Query()
+				query.Set("offset", strconv.FormatInt(consumed, 10))
+				resumeRequest.URL.RawQuery = query.Encode()
+				return resumeRequest, nil
+			},
+		}
+	})
+
+	AfterEach(func() {
+		transport.CloseIdleConnections()
+		server.Close()
+	})
+
+	readBody := func() ([]byte, error) {
+		request, err := http.NewRequest("GET", server.URL+"/events", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		response, err := resumableRoundTrip.RoundTrip(request)
+		Expect(err).NotTo(HaveOccurred())
+		defer response.Body.Close()
+
+		return io.ReadAll(response.Body)
+	}
+
+	It("resumes the stream with the request built by the resume function", func() {
+		body, err := readBody()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(Equal(strings.Join(lines, "")))
+
+		Expect(consumedWhenResumed).To(Equal([]int64{int64(len(lines[0] + lines[1]))}))
+		Expect(offsets).To(Equal([]string{"", strconv.Itoa(len(lines[0] + lines[1]))}))
+	})
+
+	Context("when the resume function fails", func() {
+		var disaster error
+
+		BeforeEach(func() {
+			disaster = errors.New("no cursor")
+			resumableRoundTrip.Resume = func(*http.Request, int64) (*http.Request, error) {
+				return nil, disaster
+			}
+		})
+
+		It("returns its error", func() {
+			body, err := readBody()
+			Expect(err).To(MatchError(disaster))
+			Expect(string(body)).To(Equal(lines[0] + lines[1]))
+		})
+	})
+
+	Context("when the resumed response is rejected", func() {
+		BeforeEach(func() {
+			resumableRoundTrip.Validate = func(response *http.Response, consumed int64) error {
+				return retryhttp.ErrNotResumed
+			}
+		})
+
+		It("fails", func() {
+			_, err := readBody()
+			Expect(err).To(MatchError(retryhttp.ErrNotResumed))
+		})
+	})
+
+	Context("when the resumed streams keep breaking right away", func() {
+		BeforeEach(func() {
+			resumesBreak = true
+			resumableRoundTrip.RetryRoundTripper.BackOffFactory = retryhttp.NewExponentialBackOffFactory(2 * time.Second)
+		})
+
+		It("gives up once the backoff policy's max elapsed time has passed", func() {
+			var (
+				body []byte
+				err  error
+			)
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				body, err = readBody()
+			}()
+
+			Eventually(done, 10*time.Second).Should(BeClosed())
+			Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+			Expect(string(body)).To(Equal(lines[0] + lines[1]))
+
+			Expect(len(consumedWhenResumed)).To(BeNumerically("<=", 3))
+			for _, consumed := range consumedWhenResumed {
+				Expect(consumed).To(Equal(int64(len(lines[0] + lines[1]))))
+			}
+		})
+	})
+
+	Context("when the backoff policy ends", func() {
+		BeforeEach(func() {
+			fakeBackOff := new(retryhttpfakes.FakeBackOff)
+			fakeBackOff.NextBackOffReturns(backoff.Stop)
+			fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+			fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+			fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+			resumableRoundTrip.RetryRoundTripper.BackOffFactory = fakeBackOffFactory
+		})
+
+		It("surfaces the read error", func() {
+			_, err := readBody()
+			Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+			Expect(consumedWhenResumed).To(BeEmpty())
+		})
+	})
+})
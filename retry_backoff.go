@@ -1,6 +1,9 @@
 package retryhttp
 
 import (
+	"errors"
+	"fmt"
+	"slices"
 	"time"
 
 	"github.com/cenkalti/backoff/v5"
@@ -41,3 +44,131 @@ func (f *exponentialBackOffFactory) NewBackOff() BackOff {
 func (f *exponentialBackOffFactory) WithMaxElapsedTime() backoff.RetryOption {
 	return backoff.WithMaxElapsedTime(f.timeout)
 }
+
+// BackOffPolicy selects a BackOffFactory for failures in any of the given
+// error categories, or for responses with any of the given status codes.
+// Listing a status code makes responses with that code retryable.
+type BackOffPolicy struct {
+	Categories     []ErrorCategory
+	StatusCodes    []int
+	BackOffFactory BackOffFactory
+}
+
+func (p BackOffPolicy) matches(category ErrorCategory, statusCode int) bool {
+	if statusCode != 0 {
+		return slices.Contains(p.StatusCodes, statusCode)
+	}
+
+	return category != "" && slices.Contains(p.Categories, category)
+}
+
+// decisionBackOff applies the most recent RetryDecision to the intervals of
+// the BackOff selected for it: the BackOff of the first matching policy, or
+// the embedded one if none match. Each policy's BackOff is created on first
+// use and keeps its state for the rest of the retry loop.
+type decisionBackOff struct {
+	BackOff
+	policies []BackOffPolicy
+	backOffs map[int]BackOff
+	current  BackOff
+	decision RetryDecision
+}
+
+func (b *decisionBackOff) apply(decision RetryDecision, statusCode int) {
+	b.decision = decision
+	b.current = b.BackOff
+
+	for i, policy := range b.policies {
+		if !policy.matches(decision.Category, statusCode) {
+			continue
+		}
+
+		if b.backOffs == nil {
+			b.backOffs = map[int]BackOff{}
+		}
+		if _, found := b.backOffs[i]; !found {
+			policyBackOff := policy.BackOffFactory.NewBackOff()
+			policyBackOff.Reset()
+			b.backOffs[i] = policyBackOff
+		}
+
+		b.current = b.backOffs[i]
+		return
+	}
+}
+
+func (b *decisionBackOff) NextBackOff() time.Duration {
+	current := b.current
+	if current == nil {
+		current = b.BackOff
+	}
+
+	if b.decision.ResetBackOff {
+		current.Reset()
+	}
+
+	next := current.NextBackOff()
+	if next == backoff.Stop || b.decision.Delay <= 0 {
+		return next
+	}
+
+	return b.decision.Delay
+}
+
+func (b *decisionBackOff) Reset() {
+	b.BackOff.Reset()
+	for _, policyBackOff := range b.backOffs {
+		policyBackOff.Reset()
+	}
+}
+
+// ErrDeadlineWouldBeExceeded is returned, wrapping the error of the last
+// attempt, when retrying stopped early because the next attempt could not
+// complete before the deadline of the request's context.
+var ErrDeadlineWouldBeExceeded = errors.New("deadline would be exceeded")
+
+// deadlineBackOff stops once waiting for the next interval and then making
+// an attempt, estimated to take as long as the previous attempts did on
+// average, would overrun the deadline.
+type deadlineBackOff struct {
+	BackOff
+	deadline time.Time
+
+	attempts    int
+	attemptTime time.Duration
+	exceeded    bool
+}
+
+func (b *deadlineBackOff) attempted(duration time.Duration) {
+	b.attempts++
+	b.attemptTime += duration
+}
+
+func (b *deadlineBackOff) NextBackOff() time.Duration {
+	next := b.BackOff.NextBackOff()
+	if next == backoff.Stop || b.deadline.IsZero() {
+		return next
+	}
+
+	var estimate time.Duration
+	if b.attempts > 0 {
+		estimate = b.attemptTime / time.Duration(b.attempts)
+	}
+
+	if time.Until(b.deadline) < next+estimate {
+		b.exceeded = true
+		return backoff.Stop
+	}
+
+	return next
+}
+
+// wrapDeadlineError wraps the error of the last attempt if retrying stopped
+// because of the deadline.
+func (b *deadlineBackOff) wrapDeadlineError(err error) error {
+	if !b.exceeded || err == nil {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrDeadlineWouldBeExceeded, err)
+}
@@ -1,12 +1,15 @@
 package retryhttp_test
 
 import (
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/lager/v3"
+	"github.com/cenkalti/backoff/v5"
 	"github.com/concourse/retryhttp"
 	"github.com/concourse/retryhttp/retryhttpfakes"
 	. "github.com/onsi/ginkgo/v2"
@@ -50,3 +53,159 @@ var _ = Describe("RetryBackoffFactory", func() {
 		})
 	})
 })
+
+var _ = Describe("BackOffPolicy", func() {
+	var (
+		fakeRoundTripper    *retryhttpfakes.FakeRoundTripper
+		defaultBackOff      *retryhttpfakes.FakeBackOff
+		resetBackOff        *retryhttpfakes.FakeBackOff
+		unavailableBackOff  *retryhttpfakes.FakeBackOff
+		resetBackOffFactory *retryhttpfakes.FakeBackOffFactory
+		retryRoundTripper   *retryhttp.RetryRoundTripper
+		response            *http.Response
+		roundTripErr        error
+	)
+
+	newFakeBackOffFactory := func(backOff retryhttp.BackOff) *retryhttpfakes.FakeBackOffFactory {
+		factory := new(retryhttpfakes.FakeBackOffFactory)
+		factory.NewBackOffReturns(backOff)
+		factory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+		return factory
+	}
+
+	BeforeEach(func() {
+		fakeRoundTripper = new(retryhttpfakes.FakeRoundTripper)
+		defaultBackOff = new(retryhttpfakes.FakeBackOff)
+		resetBackOff = new(retryhttpfakes.FakeBackOff)
+		unavailableBackOff = new(retryhttpfakes.FakeBackOff)
+		resetBackOffFactory = newFakeBackOffFactory(resetBackOff)
+
+		retryRoundTripper = &retryhttp.RetryRoundTripper{
+			Logger:         lager.NewLogger("test"),
+			BackOffFactory: newFakeBackOffFactory(defaultBackOff),
+			RoundTripper:   fakeRoundTripper,
+			BackOffPolicies: []retryhttp.BackOffPolicy{
+				{
+					Categories:     []retryhttp.ErrorCategory{retryhttp.CategoryReset},
+					BackOffFactory: resetBackOffFactory,
+				},
+				{
+					StatusCodes:    []int{http.StatusServiceUnavailable},
+					BackOffFactory: newFakeBackOffFactory(unavailableBackOff),
+				},
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		response, roundTripErr = retryRoundTripper.RoundTrip(&http.Request{URL: &url.URL{Path: "some-path"}})
+	})
+
+	Context("when the error matches a policy", func() {
+		BeforeEach(func() {
+			fakeRoundTripper.RoundTripReturnsOnCall(0, nil, syscall.ECONNRESET)
+			fakeRoundTripper.RoundTripReturnsOnCall(1, nil, syscall.ECONNRESET)
+			fakeRoundTripper.RoundTripReturnsOnCall(2, &http.Response{StatusCode: http.StatusOK}, nil)
+		})
+
+		It("waits using the policy's backoff", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(resetBackOffFactory.NewBackOffCallCount()).To(Equal(1))
+			Expect(resetBackOff.NextBackOffCallCount()).To(Equal(2))
+			Expect(defaultBackOff.NextBackOffCallCount()).To(BeZero())
+		})
+	})
+
+	Context("when the error matches a policy and the retryer only answers IsRetryable", func() {
+		var fakeRetryer *retryhttpfakes.FakeRetryer
+
+		BeforeEach(func() {
+			fakeRetryer = new(retryhttpfakes.FakeRetryer)
+			fakeRetryer.IsRetryableReturns(true)
+			retryRoundTripper.Retryer = fakeRetryer
+
+			fakeRoundTripper.RoundTripReturnsOnCall(0, nil, syscall.ECONNRESET)
+			fakeRoundTripper.RoundTripReturnsOnCall(1, &http.Response{StatusCode: http.StatusOK}, nil)
+		})
+
+		It("waits using the policy's backoff", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRetryer.IsRetryableCallCount()).To(Equal(1))
+			Expect(resetBackOff.NextBackOffCallCount()).To(Equal(1))
+			Expect(defaultBackOff.NextBackOffCallCount()).To(BeZero())
+		})
+	})
+
+	Context("when the error matches no policy", func() {
+		BeforeEach(func() {
+			fakeRoundTripper.RoundTripReturnsOnCall(0, nil, syscall.ECONNREFUSED)
+			fakeRoundTripper.RoundTripReturnsOnCall(1, &http.Response{StatusCode: http.StatusOK}, nil)
+		})
+
+		It("waits using the default backoff", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(defaultBackOff.NextBackOffCallCount()).To(Equal(1))
+			Expect(resetBackOffFactory.NewBackOffCallCount()).To(BeZero())
+		})
+	})
+
+	Context("when the response status matches a policy", func() {
+		var unavailable *http.Response
+
+		BeforeEach(func() {
+			unavailable = &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader("come back later")),
+			}
+			fakeRoundTripper.RoundTripReturnsOnCall(0, unavailable, nil)
+			fakeRoundTripper.RoundTripReturnsOnCall(1, &http.Response{StatusCode: http.StatusOK}, nil)
+		})
+
+		It("retries using the policy's backoff", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(unavailableBackOff.NextBackOffCallCount()).To(Equal(1))
+			Expect(defaultBackOff.NextBackOffCallCount()).To(BeZero())
+		})
+
+		It("drains the retried response", func() {
+			Expect(unavailable.Body.Read(make([]byte, 1))).Error().To(Equal(io.EOF))
+		})
+
+		Context("when the response has a Retry-After header", func() {
+			BeforeEach(func() {
+				unavailableBackOff.NextBackOffReturns(time.Hour)
+				unavailable.Header.Set("Retry-After", "1")
+			})
+
+			It("waits for as long as the server asks to", func() {
+				Expect(roundTripErr).NotTo(HaveOccurred())
+				Expect(response.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("when the backoff stops", func() {
+			BeforeEach(func() {
+				unavailableBackOff.NextBackOffReturns(backoff.Stop)
+			})
+
+			It("returns the last response untouched", func() {
+				Expect(roundTripErr).NotTo(HaveOccurred())
+				Expect(response).To(Equal(unavailable))
+				Expect(io.ReadAll(response.Body)).To(Equal([]byte("come back later")))
+			})
+		})
+	})
+
+	Context("when the response status matches no policy", func() {
+		BeforeEach(func() {
+			fakeRoundTripper.RoundTripReturns(&http.Response{StatusCode: http.StatusBadGateway}, nil)
+		})
+
+		It("does not retry", func() {
+			Expect(response.StatusCode).To(Equal(http.StatusBadGateway))
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+		})
+	})
+})
@@ -1,7 +1,7 @@
 package retryhttp
 
 import (
-	"context"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -15,6 +15,14 @@ type RetryHijackableClient struct {
 	BackOffFactory   BackOffFactory
 	HijackableClient HijackableClient
 	Retryer          Retryer
+	Metrics          RetryMetrics
+
+	// HealthProber, if set, short-circuits attempts to hosts that are down
+	// with ErrHostDown, which are retried. It is not consulted when
+	// HijackableClient is a DirectClient that does not send the request
+	// directly to its host, e.g. a BasicHijackableClient dialing a
+	// SocketPath.
+	HealthProber *HealthProber
 }
 
 func (d *RetryHijackableClient) Do(request *http.Request) (*http.Response, HijackCloser, error) {
@@ -23,27 +31,67 @@ func (d *RetryHijackableClient) Do(request *http.Request) (*http.Response, Hijac
 	var err error
 	var failedAttempts uint
 
-	backOff := d.BackOffFactory.NewBackOff()
+	retryer := d.Retryer
+	if retryer == nil {
+		retryer = &DefaultRetryer{}
+	}
+
+	backOff := &decisionBackOff{BackOff: d.BackOffFactory.NewBackOff()}
+	deadline, _ := request.Context().Deadline()
+	withDeadline := &deadlineBackOff{BackOff: backOff, deadline: deadline}
 	start := time.Now()
 
-	backoff.Retry(context.TODO(), func() (bool, error) {
-		response, hijackCloser, err = d.HijackableClient.Do(request)
-		retryer := d.Retryer
-		if retryer == nil {
-			retryer = &DefaultRetryer{}
+	backoff.Retry(request.Context(), func() (bool, error) {
+		attemptStart := time.Now()
+
+		var decision RetryDecision
+		if d.hostDown(request) {
+			response, hijackCloser, err = nil, nil, fmt.Errorf("%w: %s", ErrHostDown, request.URL.Host)
+			decision = RetryDecision{Retry: true, Reason: "host down"}
+		} else {
+			response, hijackCloser, err = d.HijackableClient.Do(request)
+			if err == nil {
+				return true, nil
+			}
+
+			decision = decide(retryer, err)
+		}
+
+		if !decision.Retry {
+			return true, nil
 		}
-		if err != nil && retryer.IsRetryable(err) {
-			failedAttempts++
-			d.Logger.Info("retrying", lager.Data{
-				"failed-attempts": failedAttempts,
-				"ran-for":         time.Since(start).String(),
-				"error":           err.Error(),
-			})
-			return false, err
+
+		if request.Context().Err() != nil {
+			return false, backoff.Permanent(err)
+		}
+
+		failedAttempts++
+		backOff.apply(decision, 0)
+		withDeadline.attempted(time.Since(attemptStart))
+		d.Logger.Info("retrying", lager.Data{
+			"failed-attempts": failedAttempts,
+			"ran-for":         time.Since(start).String(),
+			"error":           err.Error(),
+			"reason":          decision.Reason,
+		})
+		if d.Metrics != nil {
+			d.Metrics.Retried(decision.Reason)
 		}
+		return false, err
+	}, backoff.WithBackOff(withDeadline), d.BackOffFactory.WithMaxElapsedTime())
+
+	return response, hijackCloser, withDeadline.wrapDeadlineError(err)
+}
+
+// hostDown reports whether the HealthProber considers the request's host down.
+func (d *RetryHijackableClient) hostDown(request *http.Request) bool {
+	if d.HealthProber == nil {
+		return false
+	}
 
-		return true, nil
-	}, backoff.WithBackOff(backOff), d.BackOffFactory.WithMaxElapsedTime())
+	if client, ok := d.HijackableClient.(DirectClient); ok && !client.Direct(request) {
+		return false
+	}
 
-	return response, hijackCloser, err
+	return !d.HealthProber.Up(request.URL)
 }
@@ -1,13 +1,19 @@
 package retryhttp_test
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/lager/v3/lagertest"
 	"github.com/cenkalti/backoff/v5"
 	"github.com/concourse/retryhttp"
 	"github.com/concourse/retryhttp/retryhttpfakes"
@@ -48,11 +54,10 @@ var _ = Describe("RetryHijackableClient", func() {
 		syscall.ECONNREFUSED, // "connection refused"
 		syscall.ECONNRESET,   // "connection reset by peer"
 		syscall.ETIMEDOUT,    // "operation timed out"
-		errors.New("i/o timeout"),
-		errors.New("no such host"),
-		errors.New("handshake failure"),
-		errors.New("handshake timeout"),
-		errors.New("timeout awaiting response headers"),
+		&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded},          // "i/o timeout"
+		&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true},  // "no such host"
+		&net.OpError{Op: "remote error", Err: tls.AlertError(80)},                  // "internal error"
+		&url.Error{Op: "Get", URL: "http://example.com", Err: io.ErrUnexpectedEOF}, // "unexpected EOF"
 	}
 
 	JustBeforeEach(func() {
@@ -135,6 +140,98 @@ var _ = Describe("RetryHijackableClient", func() {
 		})
 	})
 
+	Context("when the context is canceled", func() {
+		BeforeEach(func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			fakeHijackableClient.DoReturns(nil, nil, syscall.ECONNRESET)
+
+			request = request.WithContext(ctx)
+		})
+
+		It("does not retry and returns the error", func() {
+			Expect(fakeHijackableClient.DoCallCount()).To(Equal(1))
+			Expect(clientError).To(Equal(syscall.ECONNRESET))
+		})
+	})
+
+	Context("when the context is canceled while waiting to retry", func() {
+		BeforeEach(func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(10*time.Millisecond, cancel)
+
+			fakeHijackableClient.DoReturns(nil, nil, syscall.ECONNRESET)
+			fakeBackOff.NextBackOffReturns(time.Hour)
+
+			request = request.WithContext(ctx)
+		})
+
+		It("stops waiting and returns the last error", func() {
+			Expect(fakeHijackableClient.DoCallCount()).To(Equal(1))
+			Expect(clientError).To(Equal(syscall.ECONNRESET))
+		})
+	})
+
+	Context("when the next backoff interval ends after the context deadline", func() {
+		var cancel context.CancelFunc
+
+		BeforeEach(func() {
+			var ctx context.Context
+			ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+			request = request.WithContext(ctx)
+
+			fakeHijackableClient.DoReturns(nil, nil, syscall.ECONNREFUSED)
+			fakeBackOff.NextBackOffReturns(8 * time.Second)
+		})
+
+		AfterEach(func() {
+			cancel()
+		})
+
+		It("gives up right away with the last error", func() {
+			Expect(fakeHijackableClient.DoCallCount()).To(Equal(1))
+			Expect(clientError).To(MatchError(retryhttp.ErrDeadlineWouldBeExceeded))
+			Expect(clientError).To(MatchError(syscall.ECONNREFUSED))
+		})
+	})
+
+	Context("when the retryer makes retry decisions", func() {
+		var (
+			fakeRetryer *retryhttpfakes.FakeDecisionRetryer
+			fakeMetrics *retryhttpfakes.FakeRetryMetrics
+			logger      *lagertest.TestLogger
+		)
+
+		BeforeEach(func() {
+			fakeRetryer = new(retryhttpfakes.FakeDecisionRetryer)
+			fakeRetryer.DecideReturnsOnCall(0, retryhttp.RetryDecision{Retry: true, Reason: "flaky backend", Delay: time.Millisecond})
+			fakeMetrics = new(retryhttpfakes.FakeRetryMetrics)
+			logger = lagertest.NewTestLogger("test")
+
+			retryHijackableClient.Retryer = fakeRetryer
+			retryHijackableClient.Metrics = fakeMetrics
+			retryHijackableClient.Logger = logger
+
+			fakeHijackableClient.DoReturnsOnCall(0, nil, nil, syscall.ECONNRESET)
+			fakeHijackableClient.DoReturnsOnCall(1, &http.Response{StatusCode: http.StatusOK}, nil, nil)
+			fakeBackOff.NextBackOffReturns(time.Hour)
+		})
+
+		It("retries after the delay given by the decision", func() {
+			Expect(clientError).NotTo(HaveOccurred())
+			Expect(fakeHijackableClient.DoCallCount()).To(Equal(2))
+			Expect(fakeRetryer.IsRetryableCallCount()).To(BeZero())
+		})
+
+		It("logs and reports the reason", func() {
+			Expect(logger.Logs()).To(HaveLen(1))
+			Expect(logger.Logs()[0].Data).To(HaveKeyWithValue("reason", "flaky backend"))
+			Expect(fakeMetrics.RetriedCallCount()).To(Equal(1))
+			Expect(fakeMetrics.RetriedArgsForCall(0)).To(Equal("flaky backend"))
+		})
+	})
+
 	Context("when a retryer is not provided", func() {
 		BeforeEach(func() {
 			retryHijackableClient.Retryer = nil
@@ -1,9 +1,13 @@
 package retryhttp
 
 import (
-	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/cenkalti/backoff/v5"
@@ -23,13 +27,71 @@ type RoundTripper interface {
 	RoundTrip(request *http.Request) (*http.Response, error)
 }
 
+//counterfeiter:generate . RetryMetrics
+
+// RetryMetrics is notified of every retry along with the reason given by the
+// Retryer.
+type RetryMetrics interface {
+	Retried(reason string)
+}
+
 type RetryRoundTripper struct {
 	Logger         lager.Logger
 	BackOffFactory BackOffFactory
 	RoundTripper   RoundTripper
 	Retryer        Retryer
+	Metrics        RetryMetrics
+
+	// BackOffPolicies override the BackOffFactory for specific error
+	// categories and status codes. The first matching policy is used.
+	BackOffPolicies []BackOffPolicy
+
+	// ResumeDownloads makes the body of a GET response carrying an ETag or
+	// Last-Modified header resume where it left off, using a Range request,
+	// when reading it fails with a retryable error.
+	ResumeDownloads bool
+
+	// VerifyIntegrity buffers the response bodies of idempotent requests
+	// and checks them against their Content-Length, their Content-Digest or
+	// Digest header and Checksum, if set. Responses that fail the check are
+	// discarded and the request is retried; if all attempts fail, an
+	// *IntegrityError is returned.
+	VerifyIntegrity bool
+	Checksum        ChecksumFunc
+
+	// ResponseValidator, if set, can declare responses retryable. Rejected
+	// responses are drained and closed; if every attempt is rejected, an
+	// *InvalidResponseError with the validator's reason is returned.
+	ResponseValidator   ResponseValidator
+	ValidatorPrefixSize int
+
+	// Endpoints, if set, chooses the scheme and host each attempt is sent
+	// to, so that retries fail over to other equivalent servers.
+	Endpoints Endpoints
+
+	// HealthProber, if set, is asked whether the host of each attempt is
+	// up. Attempts to hosts that are down fail right away with ErrHostDown
+	// and are retried, e.g. against the next endpoint.
+	HealthProber *HealthProber
+
+	// TokenSource, if set, provides the bearer token sent in the
+	// Authorization header of every attempt. When a response has status 401,
+	// the token is invalidated and the request is sent once more with a
+	// fresh token, outside of the backoff policy.
+	TokenSource TokenSource
+
+	// BeforeAttempt, if set, is called before every attempt. Returning an
+	// error stops retrying and returns that error.
+	BeforeAttempt BeforeAttemptFunc
 }
 
+// BeforeAttemptFunc is called with the number of the attempt, starting at 1,
+// and the error that made the previous attempt fail, if any. The request is a
+// copy made for this attempt, so its headers and URL may be changed, e.g. to
+// refresh credentials or rotate trace IDs, without affecting the caller's
+// request or other attempts.
+type BeforeAttemptFunc func(request *http.Request, attempt uint, previous error) error
+
 type RetryReadCloser struct {
 	io.ReadCloser
 	IsRead bool
@@ -41,41 +103,304 @@ func (rrc *RetryReadCloser) Read(p []byte) (n int, err error) {
 }
 
 func (d *RetryRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
-	retryReadCloser := &RetryReadCloser{request.Body, false}
+	response, err := d.roundTrip(request)
 
-	if request.Body != nil {
-		request.Body = retryReadCloser
+	if err == nil && d.ResumeDownloads && resumableDownload(request, response) {
+		response.Body = &resumableBody{
+			logger:       d.Logger,
+			roundTripper: d,
+			request:      request,
+			body:         response.Body,
+			newRequest:   newRangeRequest(rangeValidator(response)),
+			validate:     validateRangeResponse(response.ContentLength),
+		}
 	}
 
+	return response, err
+}
+
+// roundTrip sends the request, retrying failed attempts until the backoff
+// policy ends.
+func (d *RetryRoundTripper) roundTrip(request *http.Request) (*http.Response, error) {
+	retryReadCloser := &RetryReadCloser{request.Body, false}
+
 	var response *http.Response
 	var err error
 	var failedAttempts uint
 
-	backOff := d.BackOffFactory.NewBackOff()
+	retryer := d.retryer()
+
+	backOff := &decisionBackOff{
+		BackOff:  d.BackOffFactory.NewBackOff(),
+		policies: d.BackOffPolicies,
+	}
+	deadline, _ := request.Context().Deadline()
+	withDeadline := &deadlineBackOff{BackOff: backOff, deadline: deadline}
 	start := time.Now()
 
-	backoff.Retry(context.TODO(), func() (bool, error) {
-		response, err = d.RoundTripper.RoundTrip(request)
-		retryer := d.Retryer
-		if retryer == nil {
-			retryer = &DefaultRetryer{}
+	var rewindBody bool
+	var retriedResponse *http.Response
+	var previousErr error
+	var attempts uint
+	var reauthorized bool
+
+	// whether the request's context ended while waiting for the next
+	// attempt, after the retried response was discarded
+	var waiting bool
+
+	discardRetriedResponse := func(error, time.Duration) {
+		waiting = true
+		if retriedResponse != nil {
+			io.Copy(io.Discard, retriedResponse.Body)
+			retriedResponse.Body.Close()
+			retriedResponse = nil
 		}
-		if err != nil && !retryReadCloser.IsRead && retryer.IsRetryable(err) {
-			if request.Context().Err() != nil {
-				return false, backoff.Permanent(err)
+	}
+
+	_, retryErr := backoff.Retry(request.Context(), func() (bool, error) {
+		waiting = false
+
+		var endpoint *url.URL
+		attemptStart := time.Now()
+
+		for {
+			if rewindBody {
+				body, bodyErr := request.GetBody()
+				if bodyErr != nil {
+					response, err = nil, bodyErr
+					return true, nil
+				}
+
+				retryReadCloser = &RetryReadCloser{body, false}
+				rewindBody = false
+			}
+
+			attempt := attemptRequest(request)
+			if retryReadCloser.ReadCloser != nil {
+				attempt.Body = retryReadCloser
+			}
+
+			attempts++
+			if d.BeforeAttempt != nil {
+				if hookErr := d.BeforeAttempt(attempt, attempts, previousErr); hookErr != nil {
+					response, err = nil, hookErr
+					return true, nil
+				}
+			}
+
+			var token string
+			if d.TokenSource != nil {
+				token, err = d.TokenSource.Token(request.Context())
+				if err != nil {
+					response = nil
+					return true, nil
+				}
+				if attempt.Header == nil {
+					attempt.Header = http.Header{}
+				}
+				attempt.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			if d.Endpoints != nil {
+				endpoint = d.Endpoints.Next()
+				if endpoint != nil {
+					useEndpoint(attempt, endpoint)
+				}
+			}
+
+			if d.HealthProber != nil && !d.HealthProber.Up(attempt.URL) {
+				response, err = nil, fmt.Errorf("%w: %s", ErrHostDown, attempt.URL.Host)
+				break
+			}
+
+			response, err = d.RoundTripper.RoundTrip(attempt)
+
+			// a rejected token is refreshed and the request sent again
+			// right away, without counting against the backoff policy
+			if err == nil && token != "" && !reauthorized && response.StatusCode == http.StatusUnauthorized &&
+				(!retryReadCloser.IsRead || request.GetBody != nil) {
+				reauthorized = true
+				rewindBody = retryReadCloser.IsRead
+				previousErr = fmt.Errorf("received status %d", response.StatusCode)
+
+				io.Copy(io.Discard, response.Body)
+				response.Body.Close()
+
+				d.reportEndpoint(endpoint, nil)
+				d.TokenSource.Invalidate(token)
+				d.Logger.Info("refreshing-token")
+				continue
 			}
 
-			failedAttempts++
-			d.Logger.Info("retrying", lager.Data{
-				"failed-attempts": failedAttempts,
-				"ran-for":         time.Since(start).String(),
-				"error":           err.Error(),
-			})
-			return false, err
+			break
 		}
 
-		return true, nil
-	}, backoff.WithBackOff(backOff), d.BackOffFactory.WithMaxElapsedTime())
+		if err == nil && d.ResponseValidator != nil && !d.retryableStatus(response.StatusCode) {
+			response, err = validateResponse(response, d.ResponseValidator, d.ValidatorPrefixSize)
+		}
+		if err == nil && d.VerifyIntegrity && !d.retryableStatus(response.StatusCode) && verifiesIntegrity(request, response) {
+			response, err = verifyIntegrity(response, d.Checksum)
+		}
 
-	return response, err
+		var decision RetryDecision
+		var statusCode int
+		var integrityErr *IntegrityError
+		var invalidErr *InvalidResponseError
+
+		// whether the request may be sent again even though its body was
+		// already streamed, as long as the body can be rewound
+		var replayable bool
+
+		switch {
+		case errors.Is(err, ErrHostDown):
+			decision = RetryDecision{Retry: true, Reason: "host down"}
+			replayable = true
+		case errors.As(err, &invalidErr):
+			decision = RetryDecision{Retry: true, Reason: invalidErr.Reason}
+			replayable = idempotent(request.Method)
+		case errors.As(err, &integrityErr):
+			decision = RetryDecision{Retry: true, Reason: "integrity"}
+			replayable = true
+		case err != nil:
+			decision = decide(retryer, err)
+			replayable = decision.Category == CategoryUnprocessed
+		case d.retryableStatus(response.StatusCode):
+			statusCode = response.StatusCode
+			decision = statusDecision(response)
+			replayable = true
+		default:
+			d.reportEndpointOnClose(endpoint, response, attemptOutcome(request, response, nil))
+			return true, nil
+		}
+
+		if !decision.Retry {
+			if err != nil {
+				d.reportEndpoint(endpoint, attemptOutcome(request, nil, err))
+			} else {
+				d.reportEndpointOnClose(endpoint, response, attemptOutcome(request, response, nil))
+			}
+			return true, nil
+		}
+
+		retryErr := err
+		if retryErr == nil {
+			retryErr = fmt.Errorf("received status %d", statusCode)
+		}
+		d.reportEndpoint(endpoint, retryErr)
+
+		if retryReadCloser.IsRead {
+			if !replayable || request.GetBody == nil {
+				return true, nil
+			}
+			rewindBody = true
+		}
+
+		if request.Context().Err() != nil {
+			return false, backoff.Permanent(err)
+		}
+
+		if err == nil {
+			retriedResponse = response
+		}
+
+		previousErr = retryErr
+		failedAttempts++
+		backOff.apply(decision, statusCode)
+		withDeadline.attempted(time.Since(attemptStart))
+		d.Logger.Info("retrying", lager.Data{
+			"failed-attempts": failedAttempts,
+			"ran-for":         time.Since(start).String(),
+			"error":           retryErr.Error(),
+			"reason":          decision.Reason,
+		})
+		if d.Metrics != nil {
+			d.Metrics.Retried(decision.Reason)
+		}
+		return false, retryErr
+	},
+		backoff.WithBackOff(withDeadline),
+		backoff.WithNotify(discardRetriedResponse),
+		d.BackOffFactory.WithMaxElapsedTime(),
+	)
+
+	if waiting {
+		return nil, retryErr
+	}
+
+	return response, withDeadline.wrapDeadlineError(err)
+}
+
+// attemptRequest copies the request for a single attempt. Unlike
+// http.Request.Clone, the body and context are shared with the original.
+func attemptRequest(request *http.Request) *http.Request {
+	attempt := *request
+	attempt.Header = request.Header.Clone()
+
+	if request.URL != nil {
+		url := *request.URL
+		attempt.URL = &url
+	}
+
+	return &attempt
+}
+
+func (d *RetryRoundTripper) reportEndpoint(endpoint *url.URL, err error) {
+	if endpoint != nil {
+		d.Endpoints.Report(endpoint, err)
+	}
+}
+
+// reportEndpointOnClose reports the attempt that produced the returned
+// response once its body is closed, so that Endpoints counting requests in
+// flight also count the time spent streaming the body.
+func (d *RetryRoundTripper) reportEndpointOnClose(endpoint *url.URL, response *http.Response, outcome error) {
+	if endpoint != nil {
+		reportOnClose(response, func() { d.Endpoints.Report(endpoint, outcome) })
+	}
+}
+
+func (d *RetryRoundTripper) retryer() Retryer {
+	if d.Retryer == nil {
+		return &DefaultRetryer{}
+	}
+
+	return d.Retryer
+}
+
+func (d *RetryRoundTripper) retryableStatus(statusCode int) bool {
+	for _, policy := range d.BackOffPolicies {
+		if slices.Contains(policy.StatusCodes, statusCode) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// statusDecision retries a response with a retryable status code, waiting for
+// as long as its Retry-After header asks to.
+func statusDecision(response *http.Response) RetryDecision {
+	return RetryDecision{
+		Retry:  true,
+		Reason: fmt.Sprintf("status %d", response.StatusCode),
+		Delay:  retryAfter(response.Header.Get("Retry-After")),
+	}
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as an
+// HTTP date. It returns 0 if the header is missing, invalid or in the past.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+
+	return 0
 }
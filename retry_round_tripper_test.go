@@ -2,19 +2,36 @@ package retryhttp_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/lager/v3/lagertest"
 	"github.com/cenkalti/backoff/v5"
 	"github.com/concourse/retryhttp"
 	"github.com/concourse/retryhttp/retryhttpfakes"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
+	"golang.org/x/net/http2"
 )
 
 var _ = Describe("RetryRoundTripper", func() {
@@ -49,11 +66,10 @@ var _ = Describe("RetryRoundTripper", func() {
 		syscall.ECONNREFUSED, // "connection refused"
 		syscall.ECONNRESET,   // "connection reset by peer"
 		syscall.ETIMEDOUT,    // "operation timed out"
-		errors.New("i/o timeout"),
-		errors.New("no such host"),
-		errors.New("handshake failure"),
-		errors.New("handshake timeout"),
-		errors.New("timeout awaiting response headers"),
+		&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded},          // "i/o timeout"
+		&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true},  // "no such host"
+		&net.OpError{Op: "remote error", Err: tls.AlertError(80)},                  // "internal error"
+		&url.Error{Op: "Get", URL: "http://example.com", Err: io.ErrUnexpectedEOF}, // "unexpected EOF"
 	}
 
 	JustBeforeEach(func() {
@@ -101,6 +117,59 @@ var _ = Describe("RetryRoundTripper", func() {
 		})
 	}
 
+	Context("when the server did not process a request whose body was already read", func() {
+		var bodies []string
+
+		BeforeEach(func() {
+			bodies = nil
+			fakeRoundTripper.RoundTripStub = func(request *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(request.Body)
+				Expect(err).NotTo(HaveOccurred())
+				bodies = append(bodies, string(body))
+
+				if len(bodies) == 1 {
+					return nil, http2.StreamError{StreamID: 1, Code: http2.ErrCodeRefusedStream}
+				}
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			}
+			fakeBackOff.NextBackOffReturns(0)
+
+			var err error
+			request, err = http.NewRequest("POST", "http://example.com", strings.NewReader("hello"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rewinds the body and retries", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+			Expect(bodies).To(Equal([]string{"hello", "hello"}))
+		})
+
+		Context("when the body can not be rewound", func() {
+			BeforeEach(func() {
+				request.GetBody = nil
+			})
+
+			It("does not retry", func() {
+				Expect(roundTripErr).To(HaveOccurred())
+				Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the retryer only answers IsRetryable", func() {
+			BeforeEach(func() {
+				fakeRetryer := new(retryhttpfakes.FakeRetryer)
+				fakeRetryer.IsRetryableReturns(true)
+				retryRoundTripper.Retryer = fakeRetryer
+			})
+
+			It("still rewinds the body and retries", func() {
+				Expect(roundTripErr).NotTo(HaveOccurred())
+				Expect(bodies).To(Equal([]string{"hello", "hello"}))
+			})
+		})
+	})
+
 	Context("when the error is not retryable", func() {
 		var disaster error
 
@@ -178,6 +247,252 @@ var _ = Describe("RetryRoundTripper", func() {
 		})
 	})
 
+	Context("when the context is canceled while waiting for the next attempt", func() {
+		var started time.Time
+
+		BeforeEach(func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			fakeRoundTripper.RoundTripReturns(nil, syscall.ECONNREFUSED)
+			fakeBackOff.NextBackOffReturns(500 * time.Millisecond)
+
+			request = request.WithContext(ctx)
+			started = time.Now()
+		})
+
+		It("stops waiting and returns the context's error", func() {
+			Expect(time.Since(started)).To(BeNumerically("<", 400*time.Millisecond))
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+			Expect(response).To(BeNil())
+			Expect(roundTripErr).To(MatchError(context.Canceled))
+		})
+	})
+
+	Context("when the context has a deadline", func() {
+		var cancel context.CancelFunc
+
+		BeforeEach(func() {
+			var ctx context.Context
+			ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+			request = request.WithContext(ctx)
+
+			fakeRoundTripper.RoundTripReturns(nil, syscall.ECONNREFUSED)
+		})
+
+		AfterEach(func() {
+			cancel()
+		})
+
+		Context("when the next backoff interval ends after it", func() {
+			BeforeEach(func() {
+				fakeBackOff.NextBackOffReturns(8 * time.Second)
+			})
+
+			It("gives up right away with the last error", func() {
+				Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+				Expect(roundTripErr).To(MatchError(retryhttp.ErrDeadlineWouldBeExceeded))
+				Expect(roundTripErr).To(MatchError(syscall.ECONNREFUSED))
+			})
+		})
+
+		Context("when the next attempt is expected to end after it", func() {
+			BeforeEach(func() {
+				fakeRoundTripper.RoundTripStub = func(*http.Request) (*http.Response, error) {
+					time.Sleep(600 * time.Millisecond)
+					return nil, syscall.ECONNREFUSED
+				}
+				fakeBackOff.NextBackOffReturns(10 * time.Millisecond)
+			})
+
+			It("gives up right away with the last error", func() {
+				Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+				Expect(roundTripErr).To(MatchError(retryhttp.ErrDeadlineWouldBeExceeded))
+			})
+		})
+
+		Context("when there is time for more attempts", func() {
+			BeforeEach(func() {
+				fakeBackOff.NextBackOffReturnsOnCall(0, 0)
+				fakeBackOff.NextBackOffReturnsOnCall(1, backoff.Stop)
+			})
+
+			It("retries", func() {
+				Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+				Expect(roundTripErr).To(Equal(syscall.ECONNREFUSED))
+			})
+		})
+	})
+
+	Context("when a before-attempt hook is set", func() {
+		type attempt struct {
+			number   uint
+			previous error
+		}
+
+		var (
+			attempts []attempt
+			hookErr  error
+			body     io.ReadCloser
+		)
+
+		BeforeEach(func() {
+			attempts = nil
+			hookErr = nil
+
+			retryRoundTripper.BeforeAttempt = func(request *http.Request, number uint, previous error) error {
+				attempts = append(attempts, attempt{number, previous})
+				request.Header.Set("Authorization", fmt.Sprintf("Bearer token-%d", number))
+				request.URL.Host = fmt.Sprintf("replica-%d", number)
+				return hookErr
+			}
+
+			body = io.NopCloser(strings.NewReader("hello"))
+			request = &http.Request{
+				URL:    &url.URL{Scheme: "http", Host: "example.com", Path: "some-path"},
+				Header: http.Header{"Accept": {"application/json"}},
+				Body:   body,
+			}
+
+			fakeRoundTripper.RoundTripReturnsOnCall(0, nil, syscall.ECONNREFUSED)
+			fakeRoundTripper.RoundTripReturnsOnCall(1, &http.Response{StatusCode: http.StatusOK}, nil)
+			fakeBackOff.NextBackOffReturns(0)
+		})
+
+		It("is called before every attempt with the previous error", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(attempts).To(Equal([]attempt{
+				{1, nil},
+				{2, syscall.ECONNREFUSED},
+			}))
+		})
+
+		It("sends the changed request", func() {
+			first := fakeRoundTripper.RoundTripArgsForCall(0)
+			Expect(first.Header.Get("Authorization")).To(Equal("Bearer token-1"))
+			Expect(first.URL.Host).To(Equal("replica-1"))
+
+			second := fakeRoundTripper.RoundTripArgsForCall(1)
+			Expect(second.Header.Get("Authorization")).To(Equal("Bearer token-2"))
+			Expect(second.Header.Get("Accept")).To(Equal("application/json"))
+			Expect(second.URL.Host).To(Equal("replica-2"))
+		})
+
+		It("does not modify the caller's request", func() {
+			Expect(request.Header).To(Equal(http.Header{"Accept": {"application/json"}}))
+			Expect(request.URL.Host).To(Equal("example.com"))
+			Expect(request.Body).To(BeIdenticalTo(body))
+		})
+
+		Context("when the hook fails", func() {
+			BeforeEach(func() {
+				hookErr = errors.New("no token")
+			})
+
+			It("returns its error without sending the request", func() {
+				Expect(roundTripErr).To(Equal(hookErr))
+				Expect(response).To(BeNil())
+				Expect(fakeRoundTripper.RoundTripCallCount()).To(BeZero())
+			})
+		})
+	})
+
+	Context("when the retryer makes retry decisions", func() {
+		var (
+			fakeRetryer *retryhttpfakes.FakeDecisionRetryer
+			fakeMetrics *retryhttpfakes.FakeRetryMetrics
+			logger      *lagertest.TestLogger
+		)
+
+		BeforeEach(func() {
+			fakeRetryer = new(retryhttpfakes.FakeDecisionRetryer)
+			fakeRetryer.DecideReturnsOnCall(0, retryhttp.RetryDecision{Retry: true, Reason: "flaky backend"})
+			fakeMetrics = new(retryhttpfakes.FakeRetryMetrics)
+			logger = lagertest.NewTestLogger("test")
+
+			retryRoundTripper.Retryer = fakeRetryer
+			retryRoundTripper.Metrics = fakeMetrics
+			retryRoundTripper.Logger = logger
+
+			fakeRoundTripper.RoundTripReturnsOnCall(0, nil, syscall.ECONNRESET)
+			fakeRoundTripper.RoundTripReturnsOnCall(1, &http.Response{StatusCode: http.StatusOK}, nil)
+			fakeBackOff.NextBackOffReturns(0)
+		})
+
+		It("uses Decide instead of IsRetryable", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+			Expect(fakeRetryer.DecideCallCount()).To(Equal(1))
+			Expect(fakeRetryer.DecideArgsForCall(0)).To(Equal(syscall.ECONNRESET))
+			Expect(fakeRetryer.IsRetryableCallCount()).To(BeZero())
+		})
+
+		It("logs the reason", func() {
+			Expect(logger.LogMessages()).To(ConsistOf("test.retrying"))
+			Expect(logger.Logs()[0].Data).To(HaveKeyWithValue("reason", "flaky backend"))
+		})
+
+		It("reports the reason to the metrics", func() {
+			Expect(fakeMetrics.RetriedCallCount()).To(Equal(1))
+			Expect(fakeMetrics.RetriedArgsForCall(0)).To(Equal("flaky backend"))
+		})
+
+		Context("when the decision overrides the delay", func() {
+			BeforeEach(func() {
+				fakeBackOff.NextBackOffReturns(time.Hour)
+				fakeRetryer.DecideReturnsOnCall(0, retryhttp.RetryDecision{Retry: true, Delay: time.Millisecond})
+			})
+
+			It("waits for the given delay instead of the backoff interval", func() {
+				Expect(roundTripErr).NotTo(HaveOccurred())
+				Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+			})
+		})
+
+		Context("when the decision resets the backoff", func() {
+			BeforeEach(func() {
+				fakeRetryer.DecideReturnsOnCall(0, retryhttp.RetryDecision{Retry: true, ResetBackOff: true})
+			})
+
+			It("resets the backoff before computing the next interval", func() {
+				// once when the retry loop starts and once for the decision
+				Expect(fakeBackOff.ResetCallCount()).To(Equal(2))
+			})
+		})
+
+		Context("when the decision is not to retry", func() {
+			BeforeEach(func() {
+				fakeRetryer.DecideReturnsOnCall(0, retryhttp.RetryDecision{Reason: "nope"})
+			})
+
+			It("does not retry", func() {
+				Expect(roundTripErr).To(Equal(syscall.ECONNRESET))
+				Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+				Expect(fakeMetrics.RetriedCallCount()).To(BeZero())
+			})
+		})
+	})
+
+	Context("when the retryer only implements IsRetryable", func() {
+		var fakeRetryer *retryhttpfakes.FakeRetryer
+
+		BeforeEach(func() {
+			fakeRetryer = new(retryhttpfakes.FakeRetryer)
+			fakeRetryer.IsRetryableReturnsOnCall(0, true)
+			retryRoundTripper.Retryer = fakeRetryer
+
+			fakeRoundTripper.RoundTripReturnsOnCall(0, nil, syscall.ECONNRESET)
+			fakeRoundTripper.RoundTripReturnsOnCall(1, &http.Response{StatusCode: http.StatusOK}, nil)
+			fakeBackOff.NextBackOffReturns(0)
+		})
+
+		It("keeps working", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+			Expect(fakeRetryer.IsRetryableCallCount()).To(Equal(1))
+		})
+	})
+
 	Context("when a retryer is not provided", func() {
 		BeforeEach(func() {
 			retryRoundTripper.Retryer = nil
@@ -198,3 +513,238 @@ var _ = Describe("RetryRoundTripper", func() {
 		})
 	})
 })
+
+var _ = Describe("RetryRoundTripper against a TLS server", func() {
+	var (
+		server            *httptest.Server
+		transport         *http.Transport
+		fakeRoundTripper  *retryhttpfakes.FakeRoundTripper
+		retryRoundTripper *retryhttp.RetryRoundTripper
+		roundTripErr      error
+	)
+
+	BeforeEach(func() {
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		server.Config.ErrorLog = log.New(io.Discard, "", 0)
+
+		transport = &http.Transport{TLSClientConfig: &tls.Config{}}
+		fakeRoundTripper = new(retryhttpfakes.FakeRoundTripper)
+		fakeRoundTripper.RoundTripStub = func(request *http.Request) (*http.Response, error) {
+			return transport.RoundTrip(request)
+		}
+
+		fakeBackOff := new(retryhttpfakes.FakeBackOff)
+		fakeBackOff.NextBackOffStub = func() time.Duration {
+			if fakeBackOff.NextBackOffCallCount() >= 3 {
+				return backoff.Stop
+			}
+			return 0
+		}
+		fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+		fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+		fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+		retryRoundTripper = &retryhttp.RetryRoundTripper{
+			Logger:         lager.NewLogger("test"),
+			BackOffFactory: fakeBackOffFactory,
+			RoundTripper:   fakeRoundTripper,
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		transport.CloseIdleConnections()
+	})
+
+	JustBeforeEach(func() {
+		request, err := http.NewRequest("GET", server.URL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		_, roundTripErr = retryRoundTripper.RoundTrip(request)
+	})
+
+	trustServer := func() {
+		transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+		transport.TLSClientConfig.RootCAs.AddCert(server.Certificate())
+	}
+
+	Context("when the server certificate is signed by an unknown authority", func() {
+		BeforeEach(func() {
+			server.StartTLS()
+		})
+
+		It("does not retry", func() {
+			Expect(roundTripErr).To(MatchError(ContainSubstring("unknown authority")))
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when the server certificate does not match the hostname", func() {
+		BeforeEach(func() {
+			server.StartTLS()
+			trustServer()
+			transport.TLSClientConfig.ServerName = "wrong.invalid"
+		})
+
+		It("does not retry", func() {
+			Expect(roundTripErr).To(MatchError(ContainSubstring("not wrong.invalid")))
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when the server certificate has expired", func() {
+		BeforeEach(func() {
+			cert := generateCertificate(time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+			server.StartTLS()
+
+			transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+			transport.TLSClientConfig.RootCAs.AddCert(cert.Leaf)
+		})
+
+		It("does not retry", func() {
+			Expect(roundTripErr).To(MatchError(ContainSubstring("certificate has expired")))
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when the HTTP/2 server sends GOAWAY while the request is in flight", func() {
+		var h2Server *rawHTTP2Server
+
+		BeforeEach(func() {
+			var connections int32
+			h2Server = newRawHTTP2Server()
+			h2Server.HandleStream = func(framer *http2.Framer, streamID uint32) bool {
+				if atomic.AddInt32(&connections, 1) == 1 {
+					Expect(framer.WriteGoAway(streamID, http2.ErrCodeNo, nil)).To(Succeed())
+					return false
+				}
+				writeHTTP2Response(framer, streamID, http.StatusOK)
+				return true
+			}
+
+			server.Start()
+			server.URL = h2Server.URL()
+			transport = h2Server.Transport()
+		})
+
+		AfterEach(func() {
+			h2Server.Close()
+		})
+
+		It("retries on a new connection", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+		})
+	})
+
+	Context("when the server rejects the client certificate", func() {
+		BeforeEach(func() {
+			server.TLS = &tls.Config{
+				ClientAuth: tls.RequireAnyClientCert,
+				VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+					return errors.New("not on the list")
+				},
+				MaxVersion: tls.VersionTLS12,
+			}
+			server.StartTLS()
+			trustServer()
+
+			clientCert := generateCertificate(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+			transport.TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+		})
+
+		It("does not retry", func() {
+			Expect(roundTripErr).To(MatchError(ContainSubstring("bad certificate")))
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when the handshake times out", func() {
+		BeforeEach(func() {
+			server.Config.Handler = nil
+			server.Listener = stallingListener{server.Listener}
+			server.StartTLS()
+			trustServer()
+			transport.TLSHandshakeTimeout = 10 * time.Millisecond
+		})
+
+		It("retries", func() {
+			Expect(roundTripErr).To(MatchError(ContainSubstring("TLS handshake timeout")))
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(3))
+		})
+	})
+
+	Context("when the connection is reset during the handshake", func() {
+		BeforeEach(func() {
+			server.Listener = resettingListener{server.Listener}
+			server.StartTLS()
+			trustServer()
+		})
+
+		It("retries", func() {
+			Expect(roundTripErr).To(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(3))
+		})
+	})
+})
+
+// stallingListener accepts connections but never reads from them.
+type stallingListener struct {
+	net.Listener
+}
+
+func (l stallingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		}()
+	}
+}
+
+// resettingListener resets every connection it accepts.
+type resettingListener struct {
+	net.Listener
+}
+
+func (l resettingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}
+}
+
+func generateCertificate(notBefore, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	leaf, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
@@ -1,11 +1,7 @@
 package retryhttp
 
 import (
-	"errors"
-	"net"
-	"slices"
-	"strings"
-	"syscall"
+	"time"
 )
 
 //counterfeiter:generate . Retryer
@@ -14,58 +10,67 @@ type Retryer interface {
 	IsRetryable(err error) bool
 }
 
-type DefaultRetryer struct{}
+// RetryDecision describes whether and how a failed attempt should be retried.
+//
+// Delay, when positive, replaces the next interval computed by the BackOff.
+// ResetBackOff resets the BackOff before the next interval is computed.
+// Category is the error's category as determined by Classify, unless the
+// Retryer chose another one.
+type RetryDecision struct {
+	Retry        bool
+	Reason       string
+	Delay        time.Duration
+	ResetBackOff bool
+	Category     ErrorCategory
+}
 
-func (r *DefaultRetryer) IsRetryable(err error) bool {
-	if err == nil {
-		return false
-	}
+//counterfeiter:generate . DecisionRetryer
 
-	if netErr, ok := err.(net.Error); ok {
-		if netErr.Temporary() || netErr.Timeout() {
-			return true
-		}
-	}
+// DecisionRetryer is a Retryer that can explain its decisions. Retry clients
+// prefer Decide over IsRetryable when a Retryer implements it.
+type DecisionRetryer interface {
+	Retryer
+	Decide(err error) RetryDecision
+}
 
-	// Check if the error is in our predefined list of retryable errors
-	var sysErr syscall.Errno
-	if errors.As(err, &sysErr) {
-		if slices.Contains(retryableSyscallErrors, sysErr) {
-			return true
-		}
+// decide asks the retryer about err, filling in the decision's Category from
+// Classify when the retryer did not set one, so that category policies and
+// body replays apply to any Retryer.
+func decide(retryer Retryer, err error) RetryDecision {
+	var decision RetryDecision
+	if decisionRetryer, ok := retryer.(DecisionRetryer); ok {
+		decision = decisionRetryer.Decide(err)
+	} else if retryer.IsRetryable(err) {
+		decision = RetryDecision{Retry: true, Reason: "retryable error"}
+	} else {
+		decision = RetryDecision{Reason: "non-retryable error"}
 	}
 
-	// Fall back to string matching for other error types
-	errMsg := strings.ToLower(err.Error())
-	for _, msg := range retryableErrorMessages {
-		if strings.Contains(errMsg, msg) {
-			return true
-		}
+	if decision.Category == "" && err != nil {
+		decision.Category = Classify(err)
 	}
 
-	return false
+	return decision
 }
 
-// Syscall error codes that should trigger a retry
-var retryableSyscallErrors = []syscall.Errno{
-	syscall.ECONNREFUSED, // Connection refused - The server is not listening on the specified port or is unreachable
-	syscall.ECONNRESET,   // Connection reset by peer - The server abruptly closed the connection without proper termination
-	syscall.ETIMEDOUT,    // Operation timed out - The connection or request did not complete within the allotted time
-	syscall.EPIPE,        // Broken pipe - Attempt to write to a socket that has been closed by the peer
+// DefaultRetryer retries errors whose category, as determined by Classify, is
+// retryable. The category is used as the reason of the decision.
+type DefaultRetryer struct{}
+
+func (r *DefaultRetryer) IsRetryable(err error) bool {
+	return r.Decide(err).Retry
 }
 
-// Error message substrings that should trigger a retry
-var retryableErrorMessages = []string{
-	"i/o timeout",
-	"no such host",
-	"handshake failure",
-	"handshake timeout",
-	"timeout awaiting response headers",
-	"net/http: timeout awaiting response headers", // Specific to http package timeouts
-	"unexpected eof",
-	"connection reset by peer",
-	"read: connection reset by peer",
-	"read on closed response body",
-	"broken pipe",
-	"use of closed network connection",
+func (r *DefaultRetryer) Decide(err error) RetryDecision {
+	if err == nil {
+		return RetryDecision{Reason: "no error"}
+	}
+
+	category := Classify(err)
+
+	return RetryDecision{
+		Retry:    category.Retryable(),
+		Reason:   string(category),
+		Category: category,
+	}
 }
@@ -0,0 +1,181 @@
+// Code generated by counterfeiter. DO NOT EDIT.
+package retryhttpfakes
+
+import (
+	"sync"
+
+	"github.com/concourse/retryhttp"
+)
+
+type FakeDecisionRetryer struct {
+	DecideStub        func(error) retryhttp.RetryDecision
+	decideMutex       sync.RWMutex
+	decideArgsForCall []struct {
+		arg1 error
+	}
+	decideReturns struct {
+		result1 retryhttp.RetryDecision
+	}
+	decideReturnsOnCall map[int]struct {
+		result1 retryhttp.RetryDecision
+	}
+	IsRetryableStub        func(error) bool
+	isRetryableMutex       sync.RWMutex
+	isRetryableArgsForCall []struct {
+		arg1 error
+	}
+	isRetryableReturns struct {
+		result1 bool
+	}
+	isRetryableReturnsOnCall map[int]struct {
+		result1 bool
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeDecisionRetryer) Decide(arg1 error) retryhttp.RetryDecision {
+	fake.decideMutex.Lock()
+	ret, specificReturn := fake.decideReturnsOnCall[len(fake.decideArgsForCall)]
+	fake.decideArgsForCall = append(fake.decideArgsForCall, struct {
+		arg1 error
+	}{arg1})
+	stub := fake.DecideStub
+	fakeReturns := fake.decideReturns
+	fake.recordInvocation("Decide", []interface{}{arg1})
+	fake.decideMutex.Unlock()
+	if stub != nil {
+		return stub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeDecisionRetryer) DecideCallCount() int {
+	fake.decideMutex.RLock()
+	defer fake.decideMutex.RUnlock()
+	return len(fake.decideArgsForCall)
+}
+
+func (fake *FakeDecisionRetryer) DecideCalls(stub func(error) retryhttp.RetryDecision) {
+	fake.decideMutex.Lock()
+	defer fake.decideMutex.Unlock()
+	fake.DecideStub = stub
+}
+
+func (fake *FakeDecisionRetryer) DecideArgsForCall(i int) error {
+	fake.decideMutex.RLock()
+	defer fake.decideMutex.RUnlock()
+	argsForCall := fake.decideArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeDecisionRetryer) DecideReturns(result1 retryhttp.RetryDecision) {
+	fake.decideMutex.Lock()
+	defer fake.decideMutex.Unlock()
+	fake.DecideStub = nil
+	fake.decideReturns = struct {
+		result1 retryhttp.RetryDecision
+	}{result1}
+}
+
+func (fake *FakeDecisionRetryer) DecideReturnsOnCall(i int, result1 retryhttp.RetryDecision) {
+	fake.decideMutex.Lock()
+	defer fake.decideMutex.Unlock()
+	fake.DecideStub = nil
+	if fake.decideReturnsOnCall == nil {
+		fake.decideReturnsOnCall = make(map[int]struct {
+			result1 retryhttp.RetryDecision
+		})
+	}
+	fake.decideReturnsOnCall[i] = struct {
+		result1 retryhttp.RetryDecision
+	}{result1}
+}
+
+func (fake *FakeDecisionRetryer) IsRetryable(arg1 error) bool {
+	fake.isRetryableMutex.Lock()
+	ret, specificReturn := fake.isRetryableReturnsOnCall[len(fake.isRetryableArgsForCall)]
+	fake.isRetryableArgsForCall = append(fake.isRetryableArgsForCall, struct {
+		arg1 error
+	}{arg1})
+	stub := fake.IsRetryableStub
+	fakeReturns := fake.isRetryableReturns
+	fake.recordInvocation("IsRetryable", []interface{}{arg1})
+	fake.isRetryableMutex.Unlock()
+	if stub != nil {
+		return stub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeDecisionRetryer) IsRetryableCallCount() int {
+	fake.isRetryableMutex.RLock()
+	defer fake.isRetryableMutex.RUnlock()
+	return len(fake.isRetryableArgsForCall)
+}
+
+func (fake *FakeDecisionRetryer) IsRetryableCalls(stub func(error) bool) {
+	fake.isRetryableMutex.Lock()
+	defer fake.isRetryableMutex.Unlock()
+	fake.IsRetryableStub = stub
+}
+
+func (fake *FakeDecisionRetryer) IsRetryableArgsForCall(i int) error {
+	fake.isRetryableMutex.RLock()
+	defer fake.isRetryableMutex.RUnlock()
+	argsForCall := fake.isRetryableArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeDecisionRetryer) IsRetryableReturns(result1 bool) {
+	fake.isRetryableMutex.Lock()
+	defer fake.isRetryableMutex.Unlock()
+	fake.IsRetryableStub = nil
+	fake.isRetryableReturns = struct {
+		result1 bool
+	}{result1}
+}
+
+func (fake *FakeDecisionRetryer) IsRetryableReturnsOnCall(i int, result1 bool) {
+	fake.isRetryableMutex.Lock()
+	defer fake.isRetryableMutex.Unlock()
+	fake.IsRetryableStub = nil
+	if fake.isRetryableReturnsOnCall == nil {
+		fake.isRetryableReturnsOnCall = make(map[int]struct {
+			result1 bool
+		})
+	}
+	fake.isRetryableReturnsOnCall[i] = struct {
+		result1 bool
+	}{result1}
+}
+
+func (fake *FakeDecisionRetryer) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	copiedInvocations := map[string][][]interface{}{}
+	for key, value := range fake.invocations {
+		copiedInvocations[key] = value
+	}
+	return copiedInvocations
+}
+
+func (fake *FakeDecisionRetryer) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ retryhttp.DecisionRetryer = new(FakeDecisionRetryer)
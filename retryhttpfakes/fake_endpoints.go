@@ -0,0 +1,140 @@
+// Code generated by counterfeiter. DO NOT EDIT.
+package retryhttpfakes
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/concourse/retryhttp"
+)
+
+type FakeEndpoints struct {
+	NextStub        func() *url.URL
+	nextMutex       sync.RWMutex
+	nextArgsForCall []struct {
+	}
+	nextReturns struct {
+		result1 *url.URL
+	}
+	nextReturnsOnCall map[int]struct {
+		result1 *url.URL
+	}
+	ReportStub        func(*url.URL, error)
+	reportMutex       sync.RWMutex
+	reportArgsForCall []struct {
+		arg1 *url.URL
+		arg2 error
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeEndpoints) Next() *url.URL {
+	fake.nextMutex.Lock()
+	ret, specificReturn := fake.nextReturnsOnCall[len(fake.nextArgsForCall)]
+	fake.nextArgsForCall = append(fake.nextArgsForCall, struct {
+	}{})
+	stub := fake.NextStub
+	fakeReturns := fake.nextReturns
+	fake.recordInvocation("Next", []interface{}{})
+	fake.nextMutex.Unlock()
+	if stub != nil {
+		return stub()
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeEndpoints) NextCallCount() int {
+	fake.nextMutex.RLock()
+	defer fake.nextMutex.RUnlock()
+	return len(fake.nextArgsForCall)
+}
+
+func (fake *FakeEndpoints) NextCalls(stub func() *url.URL) {
+	fake.nextMutex.Lock()
+	defer fake.nextMutex.Unlock()
+	fake.NextStub = stub
+}
+
+func (fake *FakeEndpoints) NextReturns(result1 *url.URL) {
+	fake.nextMutex.Lock()
+	defer fake.nextMutex.Unlock()
+	fake.NextStub = nil
+	fake.nextReturns = struct {
+		result1 *url.URL
+	}{result1}
+}
+
+func (fake *FakeEndpoints) NextReturnsOnCall(i int, result1 *url.URL) {
+	fake.nextMutex.Lock()
+	defer fake.nextMutex.Unlock()
+	fake.NextStub = nil
+	if fake.nextReturnsOnCall == nil {
+		fake.nextReturnsOnCall = make(map[int]struct {
+			result1 *url.URL
+		})
+	}
+	fake.nextReturnsOnCall[i] = struct {
+		result1 *url.URL
+	}{result1}
+}
+
+func (fake *FakeEndpoints) Report(arg1 *url.URL, arg2 error) {
+	fake.reportMutex.Lock()
+	fake.reportArgsForCall = append(fake.reportArgsForCall, struct {
+		arg1 *url.URL
+		arg2 error
+	}{arg1, arg2})
+	stub := fake.ReportStub
+	fake.recordInvocation("Report", []interface{}{arg1, arg2})
+	fake.reportMutex.Unlock()
+	if stub != nil {
+		fake.ReportStub(arg1, arg2)
+	}
+}
+
+func (fake *FakeEndpoints) ReportCallCount() int {
+	fake.reportMutex.RLock()
+	defer fake.reportMutex.RUnlock()
+	return len(fake.reportArgsForCall)
+}
+
+func (fake *FakeEndpoints) ReportCalls(stub func(*url.URL, error)) {
+	fake.reportMutex.Lock()
+	defer fake.reportMutex.Unlock()
+	fake.ReportStub = stub
+}
+
+func (fake *FakeEndpoints) ReportArgsForCall(i int) (*url.URL, error) {
+	fake.reportMutex.RLock()
+	defer fake.reportMutex.RUnlock()
+	argsForCall := fake.reportArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeEndpoints) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	copiedInvocations := map[string][][]interface{}{}
+	for key, value := range fake.invocations {
+		copiedInvocations[key] = value
+	}
+	return copiedInvocations
+}
+
+func (fake *FakeEndpoints) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ retryhttp.Endpoints = new(FakeEndpoints)
@@ -0,0 +1,74 @@
+// Code generated by counterfeiter. DO NOT EDIT.
+package retryhttpfakes
+
+import (
+	"sync"
+
+	"github.com/concourse/retryhttp"
+)
+
+type FakeRetryMetrics struct {
+	RetriedStub        func(string)
+	retriedMutex       sync.RWMutex
+	retriedArgsForCall []struct {
+		arg1 string
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeRetryMetrics) Retried(arg1 string) {
+	fake.retriedMutex.Lock()
+	fake.retriedArgsForCall = append(fake.retriedArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	stub := fake.RetriedStub
+	fake.recordInvocation("Retried", []interface{}{arg1})
+	fake.retriedMutex.Unlock()
+	if stub != nil {
+		fake.RetriedStub(arg1)
+	}
+}
+
+func (fake *FakeRetryMetrics) RetriedCallCount() int {
+	fake.retriedMutex.RLock()
+	defer fake.retriedMutex.RUnlock()
+	return len(fake.retriedArgsForCall)
+}
+
+func (fake *FakeRetryMetrics) RetriedCalls(stub func(string)) {
+	fake.retriedMutex.Lock()
+	defer fake.retriedMutex.Unlock()
+	fake.RetriedStub = stub
+}
+
+func (fake *FakeRetryMetrics) RetriedArgsForCall(i int) string {
+	fake.retriedMutex.RLock()
+	defer fake.retriedMutex.RUnlock()
+	argsForCall := fake.retriedArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeRetryMetrics) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	copiedInvocations := map[string][][]interface{}{}
+	for key, value := range fake.invocations {
+		copiedInvocations[key] = value
+	}
+	return copiedInvocations
+}
+
+func (fake *FakeRetryMetrics) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ retryhttp.RetryMetrics = new(FakeRetryMetrics)
@@ -0,0 +1,152 @@
+// Code generated by counterfeiter. DO NOT EDIT.
+package retryhttpfakes
+
+import (
+	"context"
+	"sync"
+
+	"github.com/concourse/retryhttp"
+)
+
+type FakeTokenSource struct {
+	InvalidateStub        func(string)
+	invalidateMutex       sync.RWMutex
+	invalidateArgsForCall []struct {
+		arg1 string
+	}
+	TokenStub        func(context.Context) (string, error)
+	tokenMutex       sync.RWMutex
+	tokenArgsForCall []struct {
+		arg1 context.Context
+	}
+	tokenReturns struct {
+		result1 string
+		result2 error
+	}
+	tokenReturnsOnCall map[int]struct {
+		result1 string
+		result2 error
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeTokenSource) Invalidate(arg1 string) {
+	fake.invalidateMutex.Lock()
+	fake.invalidateArgsForCall = append(fake.invalidateArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	stub := fake.InvalidateStub
+	fake.recordInvocation("Invalidate", []interface{}{arg1})
+	fake.invalidateMutex.Unlock()
+	if stub != nil {
+		fake.InvalidateStub(arg1)
+	}
+}
+
+func (fake *FakeTokenSource) InvalidateCallCount() int {
+	fake.invalidateMutex.RLock()
+	defer fake.invalidateMutex.RUnlock()
+	return len(fake.invalidateArgsForCall)
+}
+
+func (fake *FakeTokenSource) InvalidateCalls(stub func(string)) {
+	fake.invalidateMutex.Lock()
+	defer fake.invalidateMutex.Unlock()
+	fake.InvalidateStub = stub
+}
+
+func (fake *FakeTokenSource) InvalidateArgsForCall(i int) string {
+	fake.invalidateMutex.RLock()
+	defer fake.invalidateMutex.RUnlock()
+	argsForCall := fake.invalidateArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeTokenSource) Token(arg1 context.Context) (string, error) {
+	fake.tokenMutex.Lock()
+	ret, specificReturn := fake.tokenReturnsOnCall[len(fake.tokenArgsForCall)]
+	fake.tokenArgsForCall = append(fake.tokenArgsForCall, struct {
+		arg1 context.Context
+	}{arg1})
+	stub := fake.TokenStub
+	fakeReturns := fake.tokenReturns
+	fake.recordInvocation("Token", []interface{}{arg1})
+	fake.tokenMutex.Unlock()
+	if stub != nil {
+		return stub(arg1)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *FakeTokenSource) TokenCallCount() int {
+	fake.tokenMutex.RLock()
+	defer fake.tokenMutex.RUnlock()
+	return len(fake.tokenArgsForCall)
+}
+
+func (fake *FakeTokenSource) TokenCalls(stub func(context.Context) (string, error)) {
+	fake.tokenMutex.Lock()
+	defer fake.tokenMutex.Unlock()
+	fake.TokenStub = stub
+}
+
+func (fake *FakeTokenSource) TokenArgsForCall(i int) context.Context {
+	fake.tokenMutex.RLock()
+	defer fake.tokenMutex.RUnlock()
+	argsForCall := fake.tokenArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeTokenSource) TokenReturns(result1 string, result2 error) {
+	fake.tokenMutex.Lock()
+	defer fake.tokenMutex.Unlock()
+	fake.TokenStub = nil
+	fake.tokenReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeTokenSource) TokenReturnsOnCall(i int, result1 string, result2 error) {
+	fake.tokenMutex.Lock()
+	defer fake.tokenMutex.Unlock()
+	fake.TokenStub = nil
+	if fake.tokenReturnsOnCall == nil {
+		fake.tokenReturnsOnCall = make(map[int]struct {
+			result1 string
+			result2 error
+		})
+	}
+	fake.tokenReturnsOnCall[i] = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeTokenSource) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	copiedInvocations := map[string][][]interface{}{}
+	for key, value := range fake.invocations {
+		copiedInvocations[key] = value
+	}
+	return copiedInvocations
+}
+
+func (fake *FakeTokenSource) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ retryhttp.TokenSource = new(FakeTokenSource)
@@ -0,0 +1,85 @@
+package retryhttp
+
+import (
+	"context"
+	"sync"
+)
+
+//counterfeiter:generate . TokenSource
+
+// TokenSource provides the bearer tokens used by RetryRoundTripper.
+// Invalidate is called with a token the server rejected, after which Token
+// should return a fresh one.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+	Invalidate(token string)
+}
+
+// CachingTokenSource caches the token returned by Fetch until it is
+// invalidated. Concurrent callers needing a token share a single Fetch, so a
+// burst of requests rejected with the same expired token causes only one
+// refresh.
+type CachingTokenSource struct {
+	Fetch func(ctx context.Context) (string, error)
+
+	lock  sync.Mutex
+	token string
+	fetch *tokenFetch
+}
+
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// Token returns the cached token, fetching one if there is none. The fetch
+// is not canceled along with ctx, since other callers may be waiting for it.
+func (s *CachingTokenSource) Token(ctx context.Context) (string, error) {
+	s.lock.Lock()
+
+	if s.token != "" {
+		token := s.token
+		s.lock.Unlock()
+		return token, nil
+	}
+
+	fetch := s.fetch
+	if fetch == nil {
+		fetch = &tokenFetch{done: make(chan struct{})}
+		s.fetch = fetch
+
+		go func() {
+			fetch.token, fetch.err = s.Fetch(context.WithoutCancel(ctx))
+
+			s.lock.Lock()
+			if fetch.err == nil {
+				s.token = fetch.token
+			}
+			s.fetch = nil
+			s.lock.Unlock()
+
+			close(fetch.done)
+		}()
+	}
+
+	s.lock.Unlock()
+
+	select {
+	case <-fetch.done:
+		return fetch.token, fetch.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Invalidate drops the cached token if it is the given one. A token that was
+// already replaced by a fresh one is ignored.
+func (s *CachingTokenSource) Invalidate(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.token == token {
+		s.token = ""
+	}
+}
@@ -0,0 +1,244 @@
+package retryhttp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/cenkalti/backoff/v5"
+	"github.com/concourse/retryhttp"
+	"github.com/concourse/retryhttp/retryhttpfakes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TokenSource", func() {
+	var (
+		fakeRoundTripper  *retryhttpfakes.FakeRoundTripper
+		fakeBackOff       *retryhttpfakes.FakeBackOff
+		fakeTokenSource   *retryhttpfakes.FakeTokenSource
+		retryRoundTripper *retryhttp.RetryRoundTripper
+		request           *http.Request
+		response          *http.Response
+		roundTripErr      error
+	)
+
+	unauthorized := func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusUnauthorized,
+			Body:       io.NopCloser(strings.NewReader("expired")),
+		}
+	}
+
+	BeforeEach(func() {
+		fakeRoundTripper = new(retryhttpfakes.FakeRoundTripper)
+		fakeBackOff = new(retryhttpfakes.FakeBackOff)
+		fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+		fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+		fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+		fakeTokenSource = new(retryhttpfakes.FakeTokenSource)
+		fakeTokenSource.TokenReturnsOnCall(0, "old-token", nil)
+		fakeTokenSource.TokenReturnsOnCall(1, "new-token", nil)
+
+		retryRoundTripper = &retryhttp.RetryRoundTripper{
+			Logger:         lager.NewLogger("test"),
+			BackOffFactory: fakeBackOffFactory,
+			RoundTripper:   fakeRoundTripper,
+			TokenSource:    fakeTokenSource,
+		}
+
+		var err error
+		request, err = http.NewRequest("POST", "http://example.com", strings.NewReader("hello"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		response, roundTripErr = retryRoundTripper.RoundTrip(request)
+	})
+
+	Context("when the token is accepted", func() {
+		BeforeEach(func() {
+			fakeRoundTripper.RoundTripReturns(&http.Response{StatusCode: http.StatusOK}, nil)
+		})
+
+		It("sends it in the Authorization header", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(fakeRoundTripper.RoundTripArgsForCall(0).Header.Get("Authorization")).To(Equal("Bearer old-token"))
+			Expect(request.Header.Get("Authorization")).To(BeEmpty())
+		})
+	})
+
+	Context("when the token is rejected", func() {
+		var rejected *http.Response
+		var bodies []string
+
+		BeforeEach(func() {
+			bodies = nil
+			rejected = unauthorized()
+
+			fakeRoundTripper.RoundTripStub = func(request *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(request.Body)
+				Expect(err).NotTo(HaveOccurred())
+				bodies = append(bodies, string(body))
+
+				if request.Header.Get("Authorization") == "Bearer old-token" {
+					return rejected, nil
+				}
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			}
+		})
+
+		It("invalidates it and retries with a fresh one", func() {
+			Expect(roundTripErr).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(fakeTokenSource.InvalidateCallCount()).To(Equal(1))
+			Expect(fakeTokenSource.InvalidateArgsForCall(0)).To(Equal("old-token"))
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+			Expect(fakeRoundTripper.RoundTripArgsForCall(1).Header.Get("Authorization")).To(Equal("Bearer new-token"))
+		})
+
+		It("rewinds the request body", func() {
+			Expect(bodies).To(Equal([]string{"hello", "hello"}))
+		})
+
+		It("drains the rejected response", func() {
+			Expect(io.ReadAll(rejected.Body)).To(BeEmpty())
+		})
+
+		It("does not use the backoff policy", func() {
+			Expect(fakeBackOff.NextBackOffCallCount()).To(BeZero())
+		})
+
+		Context("when the fresh token is rejected too", func() {
+			BeforeEach(func() {
+				fakeRoundTripper.RoundTripStub = nil
+				fakeRoundTripper.RoundTripReturnsOnCall(0, unauthorized(), nil)
+				fakeRoundTripper.RoundTripReturnsOnCall(1, unauthorized(), nil)
+			})
+
+			It("returns the response", func() {
+				Expect(roundTripErr).NotTo(HaveOccurred())
+				Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+				Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(2))
+				Expect(fakeTokenSource.InvalidateCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the request body can not be rewound", func() {
+			BeforeEach(func() {
+				request.GetBody = nil
+			})
+
+			It("returns the response", func() {
+				Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+				Expect(fakeRoundTripper.RoundTripCallCount()).To(Equal(1))
+			})
+		})
+	})
+
+	Context("when no token can be obtained", func() {
+		var disaster error
+
+		BeforeEach(func() {
+			disaster = errors.New("oh no!")
+			fakeTokenSource.TokenReturnsOnCall(0, "", disaster)
+		})
+
+		It("returns the error without sending the request", func() {
+			Expect(roundTripErr).To(Equal(disaster))
+			Expect(response).To(BeNil())
+			Expect(fakeRoundTripper.RoundTripCallCount()).To(BeZero())
+		})
+	})
+})
+
+var _ = Describe("CachingTokenSource", func() {
+	var (
+		fetches     atomic.Int32
+		release     chan struct{}
+		tokenSource *retryhttp.CachingTokenSource
+	)
+
+	BeforeEach(func() {
+		fetches.Store(0)
+		release = make(chan struct{})
+		close(release)
+
+		tokenSource = &retryhttp.CachingTokenSource{
+			Fetch: func(context.Context) (string, error) {
+				<-release
+				return fmt.Sprintf("token-%d", fetches.Add(1)), nil
+			},
+		}
+	})
+
+	It("caches the token", func() {
+		Expect(tokenSource.Token(context.Background())).To(Equal("token-1"))
+		Expect(tokenSource.Token(context.Background())).To(Equal("token-1"))
+		Expect(fetches.Load()).To(BeEquivalentTo(1))
+	})
+
+	It("fetches a new token once the current one is invalidated", func() {
+		Expect(tokenSource.Token(context.Background())).To(Equal("token-1"))
+		tokenSource.Invalidate("token-1")
+		Expect(tokenSource.Token(context.Background())).To(Equal("token-2"))
+	})
+
+	It("ignores invalidating a token that was already replaced", func() {
+		Expect(tokenSource.Token(context.Background())).To(Equal("token-1"))
+		tokenSource.Invalidate("token-1")
+		Expect(tokenSource.Token(context.Background())).To(Equal("token-2"))
+		tokenSource.Invalidate("token-1")
+		Expect(tokenSource.Token(context.Background())).To(Equal("token-2"))
+	})
+
+	Context("when many callers need a token at once", func() {
+		BeforeEach(func() {
+			release = make(chan struct{})
+		})
+
+		It("fetches it once", func() {
+			var wg sync.WaitGroup
+			tokens := make([]string, 10)
+			for i := range tokens {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer GinkgoRecover()
+
+					var err error
+					tokens[i], err = tokenSource.Token(context.Background())
+					Expect(err).NotTo(HaveOccurred())
+				}()
+			}
+
+			close(release)
+			wg.Wait()
+
+			Expect(fetches.Load()).To(BeEquivalentTo(1))
+			for _, token := range tokens {
+				Expect(token).To(Equal("token-1"))
+			}
+		})
+
+		It("stops waiting when the caller's context is canceled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := tokenSource.Token(ctx)
+			Expect(err).To(Equal(context.Canceled))
+
+			close(release)
+			Expect(tokenSource.Token(context.Background())).To(Equal("token-1"))
+		})
+	})
+})
@@ -0,0 +1,174 @@
+package retryhttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v5"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// UpgradeError is returned when the server answers an Upgrade request with
+// anything other than 101 Switching Protocols to the requested protocol.
+type UpgradeError struct {
+	StatusCode int
+	Protocol   string
+}
+
+func (e *UpgradeError) Error() string {
+	if e.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Sprintf("upgrade to %s refused with status %d", e.Protocol, e.StatusCode)
+	}
+	return fmt.Sprintf("server switched to a protocol other than %s", e.Protocol)
+}
+
+// Upgrader switches connections to another protocol with an HTTP/1.1 Upgrade
+// handshake sent through Client, defaulting to http.DefaultClient. Failed
+// handshakes are retried like RetryHijackableClient retries requests; once
+// the protocol was switched, nothing is retried. Client should not have a
+// Timeout, since it would apply to the upgraded connection too.
+//
+// HTTP/2 has no Upgrade, so if Client's Transport is an *http.Transport, or
+// nil, the handshake is sent through a copy of it restricted to HTTP/1.1.
+// Client must not be changed once Upgrade was called.
+type Upgrader struct {
+	Logger         lager.Logger
+	BackOffFactory BackOffFactory
+	Client         *http.Client
+	Retryer        Retryer
+	Metrics        RetryMetrics
+
+	http1Once   sync.Once
+	http1Client *http.Client
+}
+
+// Upgrade sends the request with Connection: Upgrade and Upgrade: protocol
+// headers and returns the response along with the upgraded connection. A
+// response refusing the upgrade is returned with its body closed and an
+// *UpgradeError.
+func (u *Upgrader) Upgrade(request *http.Request, protocol string) (*http.Response, io.ReadWriteCloser, error) {
+	u.http1Once.Do(u.initHTTP1Client)
+	client := u.http1Client
+
+	retryer := u.Retryer
+	if retryer == nil {
+		retryer = &DefaultRetryer{}
+	}
+
+	var response *http.Response
+	var err error
+	var failedAttempts uint
+
+	backOff := &decisionBackOff{BackOff: u.BackOffFactory.NewBackOff()}
+	deadline, _ := request.Context().Deadline()
+	withDeadline := &deadlineBackOff{BackOff: backOff, deadline: deadline}
+	start := time.Now()
+
+	backoff.Retry(request.Context(), func() (bool, error) {
+		attemptStart := time.Now()
+
+		attempt := attemptRequest(request)
+		if failedAttempts > 0 && request.Body != nil {
+			if request.GetBody == nil {
+				return true, nil
+			}
+
+			attempt.Body, err = request.GetBody()
+			if err != nil {
+				response = nil
+				return true, nil
+			}
+		}
+
+		if attempt.Header == nil {
+			attempt.Header = http.Header{}
+		}
+		attempt.Header.Set("Connection", "Upgrade")
+		attempt.Header.Set("Upgrade", protocol)
+
+		response, err = client.Do(attempt)
+		if err == nil {
+			return true, nil
+		}
+
+		decision := decide(retryer, err)
+		if !decision.Retry {
+			return true, nil
+		}
+
+		if request.Context().Err() != nil {
+			return false, backoff.Permanent(err)
+		}
+
+		failedAttempts++
+		backOff.apply(decision, 0)
+		withDeadline.attempted(time.Since(attemptStart))
+		u.Logger.Info("retrying", lager.Data{
+			"failed-attempts": failedAttempts,
+			"ran-for":         time.Since(start).String(),
+			"error":           err.Error(),
+			"reason":          decision.Reason,
+		})
+		if u.Metrics != nil {
+			u.Metrics.Retried(decision.Reason)
+		}
+		return false, err
+	}, backoff.WithBackOff(withDeadline), u.BackOffFactory.WithMaxElapsedTime())
+
+	if err != nil {
+		return nil, nil, withDeadline.wrapDeadlineError(err)
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(response.Header.Get("Upgrade"), protocol) {
+		response.Body.Close()
+		return response, nil, &UpgradeError{StatusCode: response.StatusCode, Protocol: protocol}
+	}
+
+	conn, ok := response.Body.(io.ReadWriteCloser)
+	if !ok {
+		response.Body.Close()
+		return response, nil, errors.New("upgraded response body is not writable")
+	}
+
+	return response, conn, nil
+}
+
+// initHTTP1Client derives a client that does not negotiate HTTP/2 from Client.
+func (u *Upgrader) initHTTP1Client() {
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	transport, ok := client.Transport.(*http.Transport)
+	if client.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+
+	if !ok {
+		u.http1Client = client
+		return
+	}
+
+	http1Transport := transport.Clone()
+	http1Transport.Protocols = new(http.Protocols)
+	http1Transport.Protocols.SetHTTP1(true)
+
+	// a TLS config offering h2 would still have the server pick it
+	if config := http1Transport.TLSClientConfig; config != nil {
+		config.NextProtos = slices.DeleteFunc(slices.Clone(config.NextProtos), func(proto string) bool {
+			return proto == "h2"
+		})
+	}
+
+	http1Client := *client
+	http1Client.Transport = http1Transport
+	u.http1Client = &http1Client
+}
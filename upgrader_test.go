@@ -0,0 +1,178 @@
+package retryhttp_test
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/cenkalti/backoff/v5"
+	"github.com/concourse/retryhttp"
+	"github.com/concourse/retryhttp/retryhttpfakes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upgrader", func() {
+	var (
+		attempts        atomic.Int32
+		failedAttempts  int32
+		switchedTo      string
+		receivedUpgrade chan string
+		server          *httptest.Server
+		fakeBackOff     *retryhttpfakes.FakeBackOff
+		upgrader        *retryhttp.Upgrader
+		request         *http.Request
+		response        *http.Response
+		conn            io.ReadWriteCloser
+		upgradeErr      error
+	)
+
+	BeforeEach(func() {
+		attempts.Store(0)
+		failedAttempts = 0
+		switchedTo = "echo"
+		receivedUpgrade = make(chan string, 10)
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if attempts.Add(1) <= failedAttempts {
+				conn, _, _ := http.NewResponseController(w).Hijack()
+				conn.Close()
+				return
+			}
+
+			if r.URL.Path != "/stream" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			receivedUpgrade <- r.Header.Get("Connection") + ": " + r.Header.Get("Upgrade")
+
+			conn, buffered, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+switchedTo+"\r\n\r\n")
+
+			line, err := buffered.ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "echo: "+line)
+		}))
+
+		fakeBackOff = new(retryhttpfakes.FakeBackOff)
+		fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+		fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+		fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+		upgrader = &retryhttp.Upgrader{
+			Logger:         lager.NewLogger("test"),
+			BackOffFactory: fakeBackOffFactory,
+			Client:         server.Client(),
+		}
+
+		var err error
+		request, err = http.NewRequest("POST", server.URL+"/stream", nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if conn != nil {
+			conn.Close()
+		}
+		server.Close()
+	})
+
+	JustBeforeEach(func() {
+		response, conn, upgradeErr = upgrader.Upgrade(request, "echo")
+	})
+
+	It("switches protocols", func() {
+		Expect(upgradeErr).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+		Expect(receivedUpgrade).To(Receive(Equal("Upgrade: echo")))
+		Expect(request.Header.Get("Upgrade")).To(BeEmpty())
+	})
+
+	It("returns the upgraded connection", func() {
+		_, err := io.WriteString(conn, "hello\n")
+		Expect(err).NotTo(HaveOccurred())
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(Equal("echo: hello\n"))
+	})
+
+	Context("when the server speaks HTTP/2 over TLS", func() {
+		BeforeEach(func() {
+			handler := server.Config.Handler
+			server.Close()
+
+			server = httptest.NewUnstartedServer(handler)
+			server.EnableHTTP2 = true
+			server.StartTLS()
+
+			upgrader.Client = server.Client()
+
+			var err error
+			request, err = http.NewRequest("POST", server.URL+"/stream", nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("upgrades over HTTP/1.1", func() {
+			Expect(upgradeErr).NotTo(HaveOccurred())
+			Expect(response.ProtoMajor).To(Equal(1))
+			Expect(response.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+
+			_, err := io.WriteString(conn, "hello\n")
+			Expect(err).NotTo(HaveOccurred())
+
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			Expect(err).NotTo(HaveOccurred())
+			Expect(line).To(Equal("echo: hello\n"))
+		})
+	})
+
+	Context("when the handshake fails", func() {
+		BeforeEach(func() {
+			failedAttempts = 2
+			fakeBackOff.NextBackOffReturns(0)
+		})
+
+		It("retries it", func() {
+			Expect(upgradeErr).NotTo(HaveOccurred())
+			Expect(attempts.Load()).To(BeEquivalentTo(3))
+			Expect(response.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+		})
+	})
+
+	Context("when the server refuses to upgrade", func() {
+		BeforeEach(func() {
+			request.URL.Path = "/missing"
+		})
+
+		It("returns an upgrade error without retrying", func() {
+			Expect(upgradeErr).To(MatchError(&retryhttp.UpgradeError{StatusCode: http.StatusNotFound, Protocol: "echo"}))
+			Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(conn).To(BeNil())
+			Expect(attempts.Load()).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("when the server switches to another protocol", func() {
+		BeforeEach(func() {
+			switchedTo = "websocket"
+		})
+
+		It("returns an upgrade error", func() {
+			Expect(upgradeErr).To(MatchError(&retryhttp.UpgradeError{StatusCode: http.StatusSwitchingProtocols, Protocol: "echo"}))
+			Expect(conn).To(BeNil())
+		})
+	})
+})
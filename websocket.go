@@ -0,0 +1,653 @@
+package retryhttp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v5"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// Message types of WebSocket data messages, as defined by RFC 6455.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+const (
+	opContinuation = 0
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+const (
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// maxWebSocketMessageSize bounds the size of a received message, including
+	// all of its fragments.
+	maxWebSocketMessageSize = 64 << 20
+
+	// webSocketCloseTimeout bounds how long Close waits for the server to
+	// answer the close handshake.
+	webSocketCloseTimeout = 5 * time.Second
+
+	closeNormal   = 1000
+	closeNoStatus = 1005
+)
+
+var (
+	// ErrBadHandshake is returned when the server does not accept the
+	// WebSocket opening handshake.
+	ErrBadHandshake = errors.New("websocket handshake failed")
+
+	// ErrWebSocketClosed is returned once the WebSocket was closed by Close.
+	ErrWebSocketClosed = errors.New("websocket closed")
+
+	errWebSocketProtocol = errors.New("websocket protocol error")
+)
+
+// WebSocketCloseError is returned by ReadMessage when the server closed the
+// connection with a close frame.
+type WebSocketCloseError struct {
+	Code int
+	Text string
+}
+
+func (e *WebSocketCloseError) Error() string {
+	return fmt.Sprintf("websocket closed by server with code %d: %s", e.Code, e.Text)
+}
+
+// WebSocketDialer opens RFC 6455 WebSocket connections through
+// HijackableClient, which should not retry on its own. The opening handshake
+// is retried like RetryHijackableClient retries requests; a server refusing
+// it fails with ErrBadHandshake and is not retried.
+type WebSocketDialer struct {
+	Logger           lager.Logger
+	BackOffFactory   BackOffFactory
+	HijackableClient HijackableClient
+	Retryer          Retryer
+	Metrics          RetryMetrics
+
+	// KeepAlive, if set, is the interval at which pings are sent. A
+	// connection on which nothing was received for two intervals is
+	// considered dropped. Time spent waiting for ReadMessage to take a
+	// message does not count.
+	KeepAlive time.Duration
+
+	// Reconnect makes a WebSocket whose connection dropped dial again,
+	// waiting for the next interval of a BackOff from BackOffFactory before
+	// each attempt. The BackOff is reset whenever a connection delivers
+	// messages; reconnecting gives up once connections failed to deliver
+	// messages for longer than the BackOffFactory's max elapsed time. Close
+	// aborts a reconnection in progress. Messages in flight when the
+	// connection dropped are lost.
+	Reconnect bool
+}
+
+// Dial opens a WebSocket to the request's URL, which may use the ws, wss,
+// http or https scheme.
+func (d *WebSocketDialer) Dial(request *http.Request) (*WebSocket, error) {
+	retrying := &RetryHijackableClient{
+		Logger:           d.Logger,
+		BackOffFactory:   d.BackOffFactory,
+		HijackableClient: d.HijackableClient,
+		Retryer:          d.Retryer,
+		Metrics:          d.Metrics,
+	}
+
+	session, err := d.handshake(retrying, request)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(request.Context())
+
+	ws := &WebSocket{
+		dialer:   d,
+		request:  request,
+		ctx:      ctx,
+		cancel:   cancel,
+		session:  session,
+		messages: make(chan webSocketMessage),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go ws.run(session)
+
+	return ws, nil
+}
+
+// handshake sends the opening handshake through client and validates the
+// server's answer.
+func (d *WebSocketDialer) handshake(client HijackableClient, request *http.Request) (*webSocketSession, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	attempt := attemptRequest(request)
+	attempt.Method = http.MethodGet
+	switch attempt.URL.Scheme {
+	case "ws":
+		attempt.URL.Scheme = "http"
+	case "wss":
+		attempt.URL.Scheme = "https"
+	}
+
+	if attempt.Header == nil {
+		attempt.Header = http.Header{}
+	}
+	attempt.Header.Set("Connection", "Upgrade")
+	attempt.Header.Set("Upgrade", "websocket")
+	attempt.Header.Set("Sec-WebSocket-Version", "13")
+	attempt.Header.Set("Sec-WebSocket-Key", key)
+
+	response, hijackCloser, err := client.Do(attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case response.StatusCode != http.StatusSwitchingProtocols:
+		err = fmt.Errorf("%w: status %d", ErrBadHandshake, response.StatusCode)
+	case !headerHasToken(response.Header, "Upgrade", "websocket"):
+		err = fmt.Errorf("%w: missing Upgrade: websocket", ErrBadHandshake)
+	case !headerHasToken(response.Header, "Connection", "upgrade"):
+		err = fmt.Errorf("%w: missing Connection: Upgrade", ErrBadHandshake)
+	case response.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key):
+		err = fmt.Errorf("%w: invalid Sec-WebSocket-Accept", ErrBadHandshake)
+	}
+
+	if err != nil {
+		hijackCloser.Close()
+		return nil, err
+	}
+
+	conn, reader := hijackCloser.Hijack()
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+
+	session := &webSocketSession{conn: conn, reader: reader}
+	session.lastRead.Store(time.Now().UnixNano())
+
+	return session, nil
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value expected for key.
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether the comma-separated header contains token,
+// ignoring case.
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, candidate := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(candidate), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocket is a client connection opened by a WebSocketDialer. It is safe
+// for concurrent use. Pings from the server are answered as frames arrive.
+type WebSocket struct {
+	dialer  *WebSocketDialer
+	request *http.Request
+
+	// ctx is the request's context, canceled by Close to abort reconnecting
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	session *webSocketSession
+	closing bool
+
+	messages chan webSocketMessage
+	closed   chan struct{}
+	done     chan struct{}
+	err      error
+}
+
+type webSocketMessage struct {
+	messageType int
+	data        []byte
+}
+
+// ReadMessage returns the next data message and its type. Fragmented
+// messages are returned whole.
+func (w *WebSocket) ReadMessage() (int, []byte, error) {
+	select {
+	case message := <-w.messages:
+		return message.messageType, message.data, nil
+	case <-w.done:
+		return 0, nil, w.err
+	}
+}
+
+// WriteMessage sends data as a single masked frame of messageType, which is
+// TextMessage or BinaryMessage. It fails while the WebSocket is reconnecting.
+func (w *WebSocket) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("invalid websocket message type %d", messageType)
+	}
+
+	w.lock.Lock()
+	session, closing := w.session, w.closing
+	w.lock.Unlock()
+
+	if closing {
+		return ErrWebSocketClosed
+	}
+
+	return session.writeFrame(byte(messageType), data)
+}
+
+// Close starts the close handshake and waits for the server to answer it, or
+// for a timeout, before closing the connection.
+func (w *WebSocket) Close() error {
+	w.lock.Lock()
+	if w.closing {
+		w.lock.Unlock()
+		<-w.done
+		return nil
+	}
+	w.closing = true
+	session := w.session
+	close(w.closed)
+	w.lock.Unlock()
+
+	w.cancel()
+
+	payload := binary.BigEndian.AppendUint16(nil, closeNormal)
+	err := session.writeClose(payload)
+
+	timer := time.NewTimer(webSocketCloseTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.done:
+	case <-timer.C:
+		session.conn.Close()
+		<-w.done
+	}
+
+	return err
+}
+
+func (w *WebSocket) isClosing() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.closing
+}
+
+func (w *WebSocket) run(session *webSocketSession) {
+	defer close(w.done)
+	defer w.cancel()
+
+	logger := w.dialer.Logger.Session("websocket")
+
+	backOff := &decisionBackOff{BackOff: w.dialer.BackOffFactory.NewBackOff()}
+
+	// an outage starts with the connection that dropped and lasts until a
+	// reconnected one delivers messages, each outage starting with a fresh
+	// backoff bounded by the max elapsed time
+	var dropped error
+
+	for {
+		_, err := backoff.Retry(w.ctx, func() (struct{}, error) {
+			err := dropped
+			dropped = nil
+
+			if err == nil && session == nil {
+				session, err = w.reconnect(backOff)
+			}
+
+			if err == nil {
+				var delivered bool
+				delivered, err = w.receive(session)
+				session.conn.Close()
+				session = nil
+
+				var closeErr *WebSocketCloseError
+				if w.isClosing() || errors.As(err, &closeErr) || !w.dialer.Reconnect {
+					return struct{}{}, backoff.Permanent(err)
+				}
+
+				if delivered {
+					dropped = err
+					return struct{}{}, nil
+				}
+			}
+
+			return struct{}{}, err
+		},
+			backoff.WithBackOff(backOff),
+			backoff.WithNotify(func(err error, next time.Duration) {
+				logger.Info("reconnecting", lager.Data{
+					"error": err.Error(),
+					"after": next.String(),
+				})
+			}),
+			w.dialer.BackOffFactory.WithMaxElapsedTime(),
+		)
+
+		switch {
+		case w.isClosing():
+			w.err = ErrWebSocketClosed
+			return
+		case w.ctx.Err() != nil:
+			w.err = w.ctx.Err()
+			return
+		case err != nil:
+			w.err = err
+			return
+		}
+	}
+}
+
+// receive reads messages from the session and delivers them until the
+// connection fails or the WebSocket is closed. It reports whether any message
+// was delivered.
+func (w *WebSocket) receive(session *webSocketSession) (bool, error) {
+	stopKeepAlive := w.keepAlive(session)
+	defer stopKeepAlive()
+
+	delivered := false
+	for {
+		messageType, data, err := session.readMessage()
+		if err != nil {
+			return delivered, err
+		}
+
+		// frames are not read while the consumer is busy, which must not
+		// count as silence from the server
+		session.delivering.Store(true)
+		select {
+		case w.messages <- webSocketMessage{messageType: messageType, data: data}:
+			delivered = true
+		case <-w.closed:
+			// keep reading until the server answers the close handshake
+		}
+		session.lastRead.Store(time.Now().UnixNano())
+		session.delivering.Store(false)
+	}
+}
+
+// keepAlive pings the server every KeepAlive and closes the connection if
+// nothing was received for two intervals while waiting for frames.
+func (w *WebSocket) keepAlive(session *webSocketSession) func() {
+	if w.dialer.KeepAlive <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	ticker := time.NewTicker(w.dialer.KeepAlive)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+
+			silence := time.Since(time.Unix(0, session.lastRead.Load()))
+			if silence > 2*w.dialer.KeepAlive && !session.delivering.Load() {
+				w.dialer.Logger.Info("websocket-keepalive-timeout", lager.Data{
+					"silence": silence.String(),
+				})
+				session.conn.Close()
+				return
+			}
+
+			if err := session.writeFrame(opPing, nil); err != nil {
+				return
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+// reconnect dials again for an attempt of run's backoff. The new session is
+// only used if the WebSocket was not closed during the handshake.
+func (w *WebSocket) reconnect(backOff *decisionBackOff) (*webSocketSession, error) {
+	session, err := w.dialer.handshake(w.dialer.HijackableClient, w.request.WithContext(w.ctx))
+	if err != nil {
+		if errors.Is(err, ErrBadHandshake) {
+			return nil, backoff.Permanent(err)
+		}
+
+		decision := decide(w.retryer(), err)
+		if !decision.Retry {
+			return nil, backoff.Permanent(err)
+		}
+
+		backOff.apply(decision, 0)
+		if w.dialer.Metrics != nil {
+			w.dialer.Metrics.Retried(decision.Reason)
+		}
+		return nil, err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closing {
+		session.conn.Close()
+		return nil, backoff.Permanent(ErrWebSocketClosed)
+	}
+	w.session = session
+
+	return session, nil
+}
+
+func (w *WebSocket) retryer() Retryer {
+	if w.dialer.Retryer == nil {
+		return &DefaultRetryer{}
+	}
+
+	return w.dialer.Retryer
+}
+
+// webSocketSession is a single connection of a WebSocket.
+type webSocketSession struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeLock sync.Mutex
+	closeSent bool
+
+	// lastRead is the time a frame was last received, or a message last
+	// delivered, in Unix nanoseconds.
+	lastRead atomic.Int64
+
+	// delivering is set while a received message waits for ReadMessage.
+	delivering atomic.Bool
+}
+
+// writeFrame writes a single masked frame with the FIN bit set.
+func (s *webSocketSession) writeFrame(opcode byte, payload []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.closeSent {
+		return ErrWebSocketClosed
+	}
+
+	return s.writeFrameLocked(opcode, payload)
+}
+
+// writeClose sends a close frame unless one was already sent.
+func (s *webSocketSession) writeClose(payload []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.closeSent {
+		return nil
+	}
+	s.closeSent = true
+
+	return s.writeFrameLocked(opClose, payload)
+}
+
+func (s *webSocketSession) writeFrameLocked(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+// readFrame reads a single unmasked frame from the server.
+func (s *webSocketSession) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(s.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, fmt.Errorf("%w: reserved bits set", errWebSocketProtocol)
+	}
+
+	if header[1]&0x80 != 0 {
+		return false, 0, nil, fmt.Errorf("%w: masked frame from server", errWebSocketProtocol)
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(s.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(s.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	if opcode >= opClose && (length > 125 || !fin) {
+		return false, 0, nil, fmt.Errorf("%w: invalid control frame", errWebSocketProtocol)
+	}
+
+	if length > maxWebSocketMessageSize {
+		return false, 0, nil, fmt.Errorf("%w: frame of %d bytes too large", errWebSocketProtocol, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	s.lastRead.Store(time.Now().UnixNano())
+
+	return fin, opcode, payload, nil
+}
+
+// readMessage reads frames until a whole data message was received, answering
+// pings along the way. A close frame is answered and returned as a
+// *WebSocketCloseError.
+func (s *webSocketSession) readMessage() (int, []byte, error) {
+	var messageType int
+	var message []byte
+
+	for {
+		fin, opcode, payload, err := s.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := s.writeFrame(opPong, payload); err != nil && !errors.Is(err, ErrWebSocketClosed) {
+				return 0, nil, err
+			}
+			continue
+
+		case opPong:
+			continue
+
+		case opClose:
+			closeErr := &WebSocketCloseError{Code: closeNoStatus}
+			reply := []byte(nil)
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Text = string(payload[2:])
+				reply = payload[:2]
+			}
+			s.writeClose(reply)
+			return 0, nil, closeErr
+
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, fmt.Errorf("%w: unexpected continuation frame", errWebSocketProtocol)
+			}
+
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, fmt.Errorf("%w: expected continuation frame", errWebSocketProtocol)
+			}
+			messageType = int(opcode)
+
+		default:
+			return 0, nil, fmt.Errorf("%w: unknown opcode %d", errWebSocketProtocol, opcode)
+		}
+
+		if len(message)+len(payload) > maxWebSocketMessageSize {
+			return 0, nil, fmt.Errorf("%w: message too large", errWebSocketProtocol)
+		}
+		message = append(message, payload...)
+
+		if fin {
+			return messageType, message, nil
+		}
+	}
+}
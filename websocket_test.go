@@ -0,0 +1,530 @@
+package retryhttp_test
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/cenkalti/backoff/v5"
+	"github.com/concourse/retryhttp"
+	"github.com/concourse/retryhttp/retryhttpfakes"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type webSocketFrame struct {
+	fin     bool
+	opcode  byte
+	masked  bool
+	payload []byte
+}
+
+var _ = Describe("WebSocketDialer", func() {
+	var (
+		connections    atomic.Int32
+		failedAttempts int32
+		stalled        int32
+		badAccept      bool
+		handshakes     chan http.Header
+		serve          func(conn net.Conn, reader *bufio.Reader)
+		server         *httptest.Server
+		fakeBackOff    *retryhttpfakes.FakeBackOff
+		dialer         *retryhttp.WebSocketDialer
+		request        *http.Request
+		ws             *retryhttp.WebSocket
+		dialErr        error
+	)
+
+	BeforeEach(func() {
+		connections.Store(0)
+		failedAttempts = 0
+		stalled = 0
+		badAccept = false
+		handshakes = make(chan http.Header, 10)
+		serve = func(conn net.Conn, reader *bufio.Reader) {
+			// echo data messages
+			for {
+				frame, err := readWebSocketFrame(reader)
+				if err != nil || frame.opcode == 8 {
+					return
+				}
+				writeWebSocketFrame(conn, true, frame.opcode, frame.payload)
+			}
+		}
+
+		fakeBackOff = new(retryhttpfakes.FakeBackOff)
+		fakeBackOffFactory := new(retryhttpfakes.FakeBackOffFactory)
+		fakeBackOffFactory.NewBackOffReturns(fakeBackOff)
+		fakeBackOffFactory.WithMaxElapsedTimeReturns(backoff.WithMaxElapsedTime(10 * time.Second))
+
+		dialer = &retryhttp.WebSocketDialer{
+			Logger:         lager.NewLogger("test"),
+			BackOffFactory: fakeBackOffFactory,
+			HijackableClient: &retryhttp.BasicHijackableClient{
+				DialContext:           (&net.Dialer{}).DialContext,
+				DoHijackCloserFactory: retryhttp.DefaultDoHijackCloserFactory,
+			},
+		}
+
+	})
+
+	AfterEach(func() {
+		if ws != nil {
+			ws.Close()
+			ws = nil
+		}
+		server.Close()
+	})
+
+	JustBeforeEach(func() {
+		// handlers of hijacked connections outlive the test, so they must
+		// not read variables the next test reassigns
+		serve, failedAttempts, stalled, badAccept, handshakes := serve, failedAttempts, stalled, badAccept, handshakes
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, buffered, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			connection := connections.Add(1)
+			if connection <= failedAttempts {
+				return
+			}
+
+			if connection == stalled {
+				// never answer the handshake
+				io.Copy(io.Discard, buffered)
+				return
+			}
+
+			handshakes <- r.Header
+
+			accept := webSocketAccept(r.Header.Get("Sec-WebSocket-Key"))
+			if badAccept {
+				accept = webSocketAccept("wrong")
+			}
+
+			io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+				"Upgrade: websocket\r\n"+
+				"Connection: Upgrade\r\n"+
+				"Sec-WebSocket-Accept: "+accept+"\r\n\r\n")
+
+			serve(conn, buffered.Reader)
+		}))
+
+		var err error
+		request, err = http.NewRequest("GET", strings.Replace(server.URL, "http://", "ws://", 1)+"/events", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		ws, dialErr = dialer.Dial(request)
+	})
+
+	It("sends the opening handshake", func() {
+		Expect(dialErr).NotTo(HaveOccurred())
+
+		var header http.Header
+		Expect(handshakes).To(Receive(&header))
+		Expect(header.Get("Upgrade")).To(Equal("websocket"))
+		Expect(header.Get("Connection")).To(Equal("Upgrade"))
+		Expect(header.Get("Sec-WebSocket-Version")).To(Equal("13"))
+
+		key, err := base64.StdEncoding.DecodeString(header.Get("Sec-WebSocket-Key"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key).To(HaveLen(16))
+	})
+
+	It("exchanges messages", func() {
+		Expect(ws.WriteMessage(retryhttp.TextMessage, []byte("hello"))).To(Succeed())
+		Expect(ws.WriteMessage(retryhttp.BinaryMessage, make([]byte, 70000))).To(Succeed())
+
+		messageType, data, err := ws.ReadMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(messageType).To(Equal(retryhttp.TextMessage))
+		Expect(string(data)).To(Equal("hello"))
+
+		messageType, data, err = ws.ReadMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(messageType).To(Equal(retryhttp.BinaryMessage))
+		Expect(data).To(HaveLen(70000))
+	})
+
+	Context("when the server reads a frame", func() {
+		var received chan webSocketFrame
+
+		BeforeEach(func() {
+			received = make(chan webSocketFrame, 1)
+			serve = func(conn net.Conn, reader *bufio.Reader) {
+				frame, err := readWebSocketFrame(reader)
+				if err == nil {
+					received <- frame
+				}
+			}
+		})
+
+		It("is masked", func() {
+			Expect(ws.WriteMessage(retryhttp.TextMessage, []byte("hello"))).To(Succeed())
+
+			var frame webSocketFrame
+			Eventually(received).Should(Receive(&frame))
+			Expect(frame.fin).To(BeTrue())
+			Expect(frame.masked).To(BeTrue())
+			Expect(string(frame.payload)).To(Equal("hello"))
+		})
+	})
+
+	Context("when the server sends a fragmented message with a ping in between", func() {
+		var pongs chan []byte
+
+		BeforeEach(func() {
+			pongs = make(chan []byte, 1)
+			serve = func(conn net.Conn, reader *bufio.Reader) {
+				writeWebSocketFrame(conn, false, 1, []byte("hello, "))
+				writeWebSocketFrame(conn, true, 9, []byte("are you there"))
+				writeWebSocketFrame(conn, true, 0, []byte("world"))
+
+				frame, err := readWebSocketFrame(reader)
+				if err == nil && frame.opcode == 10 {
+					pongs <- frame.payload
+				}
+				readWebSocketFrame(reader)
+			}
+		})
+
+		It("reassembles the message and answers the ping", func() {
+			messageType, data, err := ws.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(messageType).To(Equal(retryhttp.TextMessage))
+			Expect(string(data)).To(Equal("hello, world"))
+
+			Eventually(pongs).Should(Receive(Equal([]byte("are you there"))))
+		})
+	})
+
+	Context("when the server closes the connection", func() {
+		var replies chan []byte
+
+		BeforeEach(func() {
+			replies = make(chan []byte, 1)
+			serve = func(conn net.Conn, reader *bufio.Reader) {
+				writeWebSocketFrame(conn, true, 8, append(binary.BigEndian.AppendUint16(nil, 1001), "going away"...))
+
+				frame, err := readWebSocketFrame(reader)
+				if err == nil && frame.opcode == 8 {
+					replies <- frame.payload
+				}
+			}
+		})
+
+		It("answers the close handshake and returns a close error", func() {
+			_, _, err := ws.ReadMessage()
+			Expect(err).To(MatchError(&retryhttp.WebSocketCloseError{Code: 1001, Text: "going away"}))
+			Eventually(replies).Should(Receive(Equal(binary.BigEndian.AppendUint16(nil, 1001))))
+		})
+	})
+
+	Context("when the client closes the connection", func() {
+		var closes chan []byte
+
+		BeforeEach(func() {
+			closes = make(chan []byte, 1)
+			serve = func(conn net.Conn, reader *bufio.Reader) {
+				frame, err := readWebSocketFrame(reader)
+				if err == nil && frame.opcode == 8 {
+					closes <- frame.payload
+					writeWebSocketFrame(conn, true, 8, frame.payload)
+				}
+			}
+		})
+
+		It("does the close handshake", func() {
+			Expect(ws.Close()).To(Succeed())
+			Expect(closes).To(Receive(Equal(binary.BigEndian.AppendUint16(nil, 1000))))
+
+			_, _, err := ws.ReadMessage()
+			Expect(err).To(MatchError(retryhttp.ErrWebSocketClosed))
+			Expect(ws.WriteMessage(retryhttp.TextMessage, []byte("late"))).To(MatchError(retryhttp.ErrWebSocketClosed))
+		})
+	})
+
+	Context("with a keepalive", func() {
+		var pings chan struct{}
+
+		BeforeEach(func() {
+			dialer.KeepAlive = 20 * time.Millisecond
+
+			pings = make(chan struct{}, 10)
+			serve = func(conn net.Conn, reader *bufio.Reader) {
+				for {
+					frame, err := readWebSocketFrame(reader)
+					if err != nil || frame.opcode == 8 {
+						return
+					}
+					if frame.opcode == 9 {
+						select {
+						case pings <- struct{}{}:
+						default:
+						}
+						writeWebSocketFrame(conn, true, 10, frame.payload)
+					}
+				}
+			}
+		})
+
+		It("pings the server", func() {
+			Eventually(pings).Should(Receive())
+			Eventually(pings).Should(Receive())
+		})
+
+		Context("when the server stops answering", func() {
+			BeforeEach(func() {
+				serve = func(conn net.Conn, reader *bufio.Reader) {
+					io.Copy(io.Discard, reader)
+				}
+			})
+
+			It("drops the connection", func() {
+				_, _, err := ws.ReadMessage()
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when the consumer is slow to read messages", func() {
+			BeforeEach(func() {
+				dialer.Reconnect = true
+				fakeBackOff.NextBackOffReturns(0)
+
+				serve = func(conn net.Conn, reader *bufio.Reader) {
+					writeWebSocketFrame(conn, true, 1, []byte("first"))
+
+					for {
+						frame, err := readWebSocketFrame(reader)
+						if err != nil || frame.opcode == 8 {
+							return
+						}
+
+						switch frame.opcode {
+						case 1:
+							writeWebSocketFrame(conn, true, 1, []byte("second"))
+						case 9:
+							writeWebSocketFrame(conn, true, 10, frame.payload)
+						}
+					}
+				}
+			})
+
+			It("keeps the connection", func() {
+				time.Sleep(10 * dialer.KeepAlive)
+
+				_, data, err := ws.ReadMessage()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(Equal("first"))
+
+				Expect(ws.WriteMessage(retryhttp.TextMessage, []byte("next"))).To(Succeed())
+
+				_, data, err = ws.ReadMessage()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(Equal("second"))
+
+				Expect(connections.Load()).To(BeEquivalentTo(1))
+			})
+		})
+	})
+
+	Context("when the handshake fails", func() {
+		BeforeEach(func() {
+			failedAttempts = 2
+			fakeBackOff.NextBackOffReturns(0)
+		})
+
+		It("retries it", func() {
+			Expect(dialErr).NotTo(HaveOccurred())
+			Expect(connections.Load()).To(BeEquivalentTo(3))
+		})
+	})
+
+	Context("when the server answers with the wrong Sec-WebSocket-Accept", func() {
+		BeforeEach(func() {
+			badAccept = true
+		})
+
+		It("fails without retrying", func() {
+			Expect(dialErr).To(MatchError(retryhttp.ErrBadHandshake))
+			Expect(connections.Load()).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("when the connection drops", func() {
+		BeforeEach(func() {
+			serve = func(conn net.Conn, reader *bufio.Reader) {
+				if connections.Load() == 1 {
+					return
+				}
+				writeWebSocketFrame(conn, true, 1, []byte("reconnected"))
+				readWebSocketFrame(reader)
+			}
+		})
+
+		It("returns the error", func() {
+			_, _, err := ws.ReadMessage()
+			Expect(err).To(HaveOccurred())
+			Expect(connections.Load()).To(BeEquivalentTo(1))
+		})
+
+		Context("with reconnection", func() {
+			BeforeEach(func() {
+				dialer.Reconnect = true
+				fakeBackOff.NextBackOffReturns(0)
+			})
+
+			It("dials again", func() {
+				_, data, err := ws.ReadMessage()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data)).To(Equal("reconnected"))
+				Expect(connections.Load()).To(BeEquivalentTo(2))
+			})
+
+			Context("when the BackOff stops", func() {
+				BeforeEach(func() {
+					fakeBackOff.NextBackOffReturns(backoff.Stop)
+				})
+
+				It("returns the error", func() {
+					_, _, err := ws.ReadMessage()
+					Expect(err).To(HaveOccurred())
+					Expect(connections.Load()).To(BeEquivalentTo(1))
+				})
+			})
+
+			Context("when the WebSocket is closed during the reconnection handshake", func() {
+				BeforeEach(func() {
+					stalled = 2
+				})
+
+				It("aborts the handshake", func() {
+					Eventually(connections.Load).Should(BeEquivalentTo(2))
+
+					closed := make(chan struct{})
+					go func() {
+						defer close(closed)
+						ws.Close()
+					}()
+					Eventually(closed).Should(BeClosed())
+
+					_, _, err := ws.ReadMessage()
+					Expect(err).To(MatchError(retryhttp.ErrWebSocketClosed))
+				})
+			})
+
+			Context("when reconnected connections keep dropping right away", func() {
+				BeforeEach(func() {
+					dialer.BackOffFactory = retryhttp.NewExponentialBackOffFactory(2 * time.Second)
+					serve = func(conn net.Conn, reader *bufio.Reader) {
+						if connections.Load() == 1 {
+							writeWebSocketFrame(conn, true, 1, []byte("first"))
+						}
+					}
+				})
+
+				It("gives up once the backoff policy's max elapsed time has passed", func() {
+					_, data, err := ws.ReadMessage()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(data)).To(Equal("first"))
+
+					errs := make(chan error, 1)
+					go func() {
+						_, _, err := ws.ReadMessage()
+						errs <- err
+					}()
+					Eventually(errs, 10*time.Second).Should(Receive(HaveOccurred()))
+					Expect(connections.Load()).To(BeNumerically("<=", 6))
+				})
+			})
+		})
+	})
+})
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeWebSocketFrame writes an unmasked frame, as servers do.
+func writeWebSocketFrame(conn net.Conn, fin bool, opcode byte, payload []byte) {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	conn.Write(append(frame, payload...))
+}
+
+// readWebSocketFrame reads a frame and unmasks its payload.
+func readWebSocketFrame(reader *bufio.Reader) (webSocketFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return webSocketFrame{}, err
+	}
+
+	frame := webSocketFrame{
+		fin:    header[0]&0x80 != 0,
+		opcode: header[0] & 0x0f,
+		masked: header[1]&0x80 != 0,
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return webSocketFrame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return webSocketFrame{}, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	var mask [4]byte
+	if frame.masked {
+		if _, err := io.ReadFull(reader, mask[:]); err != nil {
+			return webSocketFrame{}, err
+		}
+	}
+
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(reader, frame.payload); err != nil {
+		return webSocketFrame{}, err
+	}
+
+	for i := range frame.payload {
+		frame.payload[i] ^= mask[i%4]
+	}
+
+	return frame, nil
+}